@@ -0,0 +1,148 @@
+// Package apiclient is a typed client for the JSON API of a running gowarp server,
+// as described by its OpenAPI document (served at /api/v1/openapi.json).
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key is a key handed out by the server.
+type Key struct {
+	License  string      `json:"license"`
+	Type     string      `json:"account_type"`
+	RefCount json.Number `json:"referral_count"`
+}
+
+// Config is a key handed out by the server, together with the WireGuard config
+// of a device the server registered with it.
+type Config struct {
+	Key
+	Config string `json:"config"`
+}
+
+// Pool describes the current state of the server's key pool.
+type Pool struct {
+	Size int64 `json:"size"`
+}
+
+// Error is the error payload returned by the server.
+type Error struct {
+	Message string `json:"error"`
+	Status  int    `json:"status"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("apiclient: server responded with %d: %s", e.Status, e.Message)
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	hc      *http.Client
+}
+
+// Option configures the Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the *http.Client used to make the requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.hc = hc
+	}
+}
+
+// WithToken sets the bearer token sent with every request,
+// it is required if the server runs with REQUIRE_AUTH.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New returns a client for the server at baseURL, e.g. "https://gowarp.example.com".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/api/v1",
+		hc:      &http.Client{Timeout: 2 * time.Minute},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// CreateKey asks the server to hand out a key.
+func (c *Client) CreateKey(ctx context.Context) (*Key, error) {
+	var key Key
+	if err := c.do(ctx, http.MethodPost, c.baseURL+"/keys", http.StatusCreated, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// CreateConfig asks the server to hand out a key together with the WireGuard config of a new
+// device using it. The device stays registered by the server.
+func (c *Client) CreateConfig(ctx context.Context) (*Config, error) {
+	var conf Config
+	if err := c.do(ctx, http.MethodPost, c.baseURL+"/configs", http.StatusCreated, &conf); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+// Pool returns the state of the server's key pool.
+func (c *Client) Pool(ctx context.Context) (*Pool, error) {
+	var pool Pool
+	if err := c.do(ctx, http.MethodGet, c.baseURL+"/pool", http.StatusOK, &pool); err != nil {
+		return nil, err
+	}
+
+	return &pool, nil
+}
+
+// do sends the request and decodes the response into out,
+// or returns an *Error if the response status is not the expected one.
+func (c *Client) do(ctx context.Context, method, url string, expected int, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("apiclient: failed to create the request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("apiclient: request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expected {
+		apiErr := &Error{Status: res.StatusCode}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(body))
+			if apiErr.Message == "" {
+				apiErr.Message = http.StatusText(res.StatusCode)
+			}
+		}
+		apiErr.Status = res.StatusCode
+		return apiErr
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("apiclient: failed to decode the response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package apiclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/handsomefox/gowarp/apiclient"
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/client/clienttest"
+	"github.com/handsomefox/gowarp/cmd/http/server"
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/auth"
+	"github.com/handsomefox/gowarp/internal/models/memory"
+)
+
+// newTestServer runs a gowarp server with an empty in-memory pool that talks to a fake upstream.
+func newTestServer(t *testing.T, cfg server.Config) (*httptest.Server, *clienttest.Server) {
+	t.Helper()
+
+	fake := clienttest.NewServer()
+	t.Cleanup(fake.Close)
+
+	db, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The JSON API renders no templates.
+	cfg.ClientOptions = append(cfg.ClientOptions, client.WithConfiguration(fake.Configuration()))
+	s, err := server.New(context.Background(), db, templates.Map{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	return ts, fake
+}
+
+func TestCreateKey(t *testing.T) {
+	ts, _ := newTestServer(t, server.Config{})
+
+	key, err := apiclient.New(ts.URL + "/").CreateKey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.License == "" || key.Type == "" || key.RefCount == "" {
+		t.Errorf("CreateKey() = %+v, want every field set", key)
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	ts, fake := newTestServer(t, server.Config{})
+
+	conf, err := apiclient.New(ts.URL).CreateConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.License == "" {
+		t.Error("license is empty")
+	}
+	if !strings.Contains(conf.Config, "PublicKey = "+clienttest.PeerPublicKey) {
+		t.Errorf("config doesn't contain the peer:\n%s", conf.Config)
+	}
+	if n := fake.Devices(); n != 1 {
+		t.Errorf("%d devices are registered, want the device of the config only", n)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ts, _ := newTestServer(t, server.Config{})
+
+	pool, err := apiclient.New(ts.URL).Pool(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Size != 0 {
+		t.Errorf("Size = %d, want the empty pool", pool.Size)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	tokens, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, fake := newTestServer(t, server.Config{RequireAuth: true, Tokens: tokens, Counters: tokens})
+
+	secret, _, err := auth.Issue(ctx, tokens, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		fault  bool
+		status int
+	}{
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "invalid token", token: "gw_invalid", status: http.StatusUnauthorized},
+		{name: "upstream failure", token: secret, fault: true, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.ClearFaults()
+			if tt.fault {
+				fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Status: http.StatusInternalServerError})
+			}
+
+			_, err := apiclient.New(ts.URL, apiclient.WithToken(tt.token)).CreateConfig(ctx)
+			var apiErr *apiclient.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("CreateConfig() error = %v, want an *apiclient.Error", err)
+			}
+			if apiErr.Status != tt.status || apiErr.Message == "" {
+				t.Errorf("error = %+v, want status %d with a message", apiErr, tt.status)
+			}
+		})
+	}
+
+	fake.ClearFaults()
+	if _, err := apiclient.New(ts.URL, apiclient.WithToken(secret)).CreateConfig(ctx); err != nil {
+		t.Errorf("CreateConfig() with a valid token = %v", err)
+	}
+}
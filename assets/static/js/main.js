@@ -1,3 +1,11 @@
 document.getElementById("gen_btn").onclick = function () {
   window.location.href = "/key/generate";
 };
+
+document.getElementById("cfg_btn").onclick = function () {
+  window.location.href = "/key/config";
+};
+
+document.getElementById("qr_btn").onclick = function () {
+  window.location.href = "/key/qr";
+};
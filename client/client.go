@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"io"
 	"math/big"
 	"net/http"
 	"time"
@@ -18,10 +20,54 @@ type Client struct {
 	cl      *http.Client
 	config  *ConfigurationData
 	logging bool
+	timing  func(op string, d time.Duration)
 }
 
-func NewClient(logging bool) *Client {
-	return &Client{
+// Option configures the Client.
+type Option func(*Client)
+
+// WithTimingObserver makes the client report the duration of every call, e.g. to export it as a metric.
+// The op is the name of the method, e.g. "NewAccount".
+func WithTimingObserver(f func(op string, d time.Duration)) Option {
+	return func(c *Client) {
+		c.timing = f
+	}
+}
+
+// WithLogging enables the logging of the errors and timings of the calls.
+func WithLogging(logging bool) Option {
+	return func(c *Client) {
+		c.logging = logging
+	}
+}
+
+// WithConfiguration makes the client use cfg instead of the configuration read from the environment,
+// e.g. to talk to a fake upstream from the clienttest package.
+func WithConfiguration(cfg ConfigurationData) Option {
+	return func(c *Client) {
+		cfg.Keys = cleanKeys(cfg.Keys)
+		c.config = &cfg
+	}
+}
+
+// NewClientWithConfig returns a client that uses cfg, or an error wrapping ErrInvalidConfiguration
+// if a required field of cfg is empty. The blank keys are dropped.
+func NewClientWithConfig(cfg ConfigurationData, opts ...Option) (*Client, error) {
+	cfg.Keys = cleanKeys(cfg.Keys)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.WaitTime == 0 {
+		cfg.WaitTime = defaultWaitTime
+	}
+
+	return NewClient(false, append([]Option{WithConfiguration(cfg)}, opts...)...), nil
+}
+
+// NewClient returns a client configured from the unprefixed environment variables, see GetConfiguration.
+// Use NewClientWithConfig or WithConfiguration to pass the configuration explicitly.
+func NewClient(logging bool, opts ...Option) *Client {
+	c := &Client{
 		cl: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{
@@ -39,6 +85,18 @@ func NewClient(logging bool) *Client {
 		config:  GetConfiguration(),
 		logging: logging,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Configuration returns a copy of the configuration used by the client.
+func (c *Client) Configuration() ConfigurationData {
+	cfg := *c.config
+	cfg.Keys = append([]string(nil), c.config.Keys...)
+	return cfg
 }
 
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
@@ -50,192 +108,300 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 }
 
 func (c *Client) NewAccount(ctx context.Context) (*Account, error) {
-	defer c.logTiming("NewAccount", time.Now())
+	const op = "NewAccount"
+	defer c.logTiming(op, time.Now())
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.BaseURL+"/reg", http.NoBody)
+	keys, err := GenerateKeyPair()
 	if err != nil {
-		c.logError(err)
-		return nil, ErrRegAccount
+		return nil, c.fail(&Error{Op: op, Kind: ErrRegAccount, Err: err})
 	}
 
-	res, err := c.Do(req)
+	payload, err := json.Marshal(map[string]string{
+		"key":    keys.PublicKey,
+		"tos":    time.Now().UTC().Format(time.RFC3339),
+		"type":   "Android",
+		"locale": "en_US",
+	})
 	if err != nil {
-		c.logError(err)
-		return nil, ErrRegAccount
+		return nil, c.fail(&Error{Op: op, Kind: ErrEncodeAccount, Err: err})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.BaseURL+"/reg", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, c.fail(&Error{Op: op, Kind: ErrRegAccount, Err: err})
 	}
-	defer res.Body.Close()
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 
 	var acc Account
-	if err := json.NewDecoder(res.Body).Decode(&acc); err != nil {
-		c.logError(err)
-		return nil, ErrDecodeAccount
+	if err := c.send(req, op, ErrRegAccount, &acc); err != nil {
+		return nil, err
 	}
+	acc.PrivateKey = keys.PrivateKey
 
 	return &acc, nil
 }
 
+// NewDevice registers a device and applies the license to it, if one is given.
+// Unlike the accounts used by NewAccountWithLicense, the device stays registered,
+// so its WireGuard configuration can be used, see Account.WireGuardConfig.
+func (c *Client) NewDevice(ctx context.Context, license string) (*Account, error) {
+	defer c.logTiming("NewDevice", time.Now())
+
+	acc, err := c.NewAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if license == "" {
+		return acc, nil
+	}
+
+	if err := c.ApplyKey(ctx, acc, license); err != nil {
+		return nil, &StepError{Step: StepApplyKey, Err: err, Cleanup: c.removeDevices(ctx, []*Account{acc})}
+	}
+	acc.Account.License = license
+
+	return acc, nil
+}
+
 func (c *Client) AddReferrer(ctx context.Context, acc, referrer *Account) error {
-	defer c.logTiming("AddReferrer", time.Now())
+	const op = "AddReferrer"
+	defer c.logTiming(op, time.Now())
 
 	payload, err := json.Marshal(map[string]string{"referrer": referrer.ID})
 	if err != nil {
-		c.logError(err)
-		return ErrEncodeAccount
+		return c.fail(&Error{Op: op, Kind: ErrEncodeAccount, Err: err})
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.config.BaseURL+"/reg/"+acc.ID, bytes.NewBuffer(payload))
 	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
+		return c.fail(&Error{Op: op, Kind: ErrUpdateAccount, Err: err})
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("Authorization", "Bearer "+acc.Token)
 
-	res, err := c.Do(req)
-	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
-	}
-	defer res.Body.Close()
-
-	return nil
+	return c.send(req, op, ErrUpdateAccount, nil)
 }
 
 func (c *Client) RemoveDevice(ctx context.Context, acc *Account) error {
-	defer c.logTiming("RemoveDevice", time.Now())
+	const op = "RemoveDevice"
+	defer c.logTiming(op, time.Now())
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.config.BaseURL+"/reg/"+acc.ID, http.NoBody)
 	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
+		return c.fail(&Error{Op: op, Kind: ErrUpdateAccount, Err: err})
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("Authorization", "Bearer "+acc.Token)
 
-	res, err := c.Do(req)
-	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
-	}
-	defer res.Body.Close()
-
-	return nil
+	return c.send(req, op, ErrUpdateAccount, nil)
 }
 
 func (c *Client) ApplyKey(ctx context.Context, acc *Account, key string) error {
-	defer c.logTiming("ApplyKey", time.Now())
+	const op = "ApplyKey"
+	defer c.logTiming(op, time.Now())
 
 	payload, err := json.Marshal(map[string]string{"license": key})
 	if err != nil {
-		c.logError(err)
-		return ErrEncodeAccount
+		return c.fail(&Error{Op: op, Kind: ErrEncodeAccount, Err: err})
 	}
 
 	req, err := http.NewRequestWithContext(
 		ctx, http.MethodPut, c.config.BaseURL+"/reg/"+acc.ID+"/account", bytes.NewBuffer(payload))
 	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
+		return c.fail(&Error{Op: op, Kind: ErrUpdateAccount, Err: err})
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("Authorization", "Bearer "+acc.Token)
 
-	res, err := c.Do(req)
-	if err != nil {
-		c.logError(err)
-		return ErrUpdateAccount
-	}
-	defer res.Body.Close()
-
-	return nil
+	return c.send(req, op, ErrUpdateAccount, nil)
 }
 
 func (c *Client) GetAccountData(ctx context.Context, acc *Account) (*models.Account, error) {
-	defer c.logTiming("GetAccountData", time.Now())
+	const op = "GetAccountData"
+	defer c.logTiming(op, time.Now())
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.BaseURL+"/reg/"+acc.ID+"/account", http.NoBody)
 	if err != nil {
-		c.logError(err)
-		return nil, ErrGetAccountData
+		return nil, c.fail(&Error{Op: op, Kind: ErrGetAccountData, Err: err})
 	}
 
 	req.Header.Set("Authorization", "Bearer "+acc.Token)
 
-	res, err := c.Do(req)
-	if err != nil {
-		c.logError(err)
-		return nil, ErrGetAccountData
-	}
-	defer res.Body.Close()
-
 	var accountData models.Account
-	if err := json.NewDecoder(res.Body).Decode(&accountData); err != nil {
-		c.logError(err)
-		return nil, ErrDecodeAccount
+	if err := c.send(req, op, ErrGetAccountData, &accountData); err != nil {
+		return nil, err
 	}
 
 	return &accountData, nil
 }
 
-// NewAccountWithLicense creates models.Account with random license.
-func (c *Client) NewAccountWithLicense(ctx context.Context) (*models.Account, error) {
-	defer c.logTiming("NewAccountWithLicense", time.Now())
+// maxBodySize limits how much of a response body the client reads.
+const maxBodySize = 1 << 20
 
-	keyAccount, err := c.NewAccount(ctx)
+// send performs the request and decodes the JSON response into v, unless v is nil.
+// Every failure is returned as an *Error of the given kind, except for the decoding
+// failures, which are reported as ErrDecodeAccount. Non-2xx statuses are failures as well.
+func (c *Client) send(req *http.Request, op string, kind error, v any) error {
+	res, err := c.Do(req)
 	if err != nil {
-		return nil, err
+		return c.fail(&Error{Op: op, Kind: kind, Err: err})
 	}
+	defer res.Body.Close()
 
-	tempAccount, err := c.NewAccount(ctx)
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBodySize))
 	if err != nil {
-		return nil, err
+		return c.fail(&Error{Op: op, Kind: kind, StatusCode: res.StatusCode, Err: err})
 	}
 
-	if err := c.AddReferrer(ctx, keyAccount, tempAccount); err != nil {
-		return nil, err
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return c.fail(&Error{Op: op, Kind: kind, StatusCode: res.StatusCode, Body: snippet(body)})
 	}
 
-	if err := c.RemoveDevice(ctx, tempAccount); err != nil {
-		return nil, err
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return c.fail(&Error{Op: op, Kind: ErrDecodeAccount, StatusCode: res.StatusCode, Body: snippet(body), Err: err})
 	}
 
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(c.config.Keys)))) // [0; Length)
-	if err != nil {
-		n = big.NewInt(0)
+	return nil
+}
+
+// NewAccountWithLicense creates models.Account with random license.
+//
+// It runs as a saga: if any step fails, the devices registered by the previous steps
+// are removed again, and the returned *StepError names the step that failed.
+func (c *Client) NewAccountWithLicense(ctx context.Context) (*models.Account, error) {
+	defer c.logTiming("NewAccountWithLicense", time.Now())
+
+	acc, _, err := c.newAccountWithLicense(ctx, false)
+	return acc, err
+}
+
+// NewDeviceWithLicense is like NewAccountWithLicense, but the device holding the license
+// stays registered and is returned as well, e.g. to manage it or to use its WireGuard config later.
+func (c *Client) NewDeviceWithLicense(ctx context.Context) (*models.Account, *Account, error) {
+	defer c.logTiming("NewDeviceWithLicense", time.Now())
+
+	return c.newAccountWithLicense(ctx, true)
+}
+
+// sagaStep is a step of newAccountWithLicense.
+type sagaStep struct {
+	step Step
+	run  func() error
+}
+
+func (c *Client) newAccountWithLicense(ctx context.Context, keepDevice bool) (*models.Account, *Account, error) {
+	var (
+		keyAccount  *Account
+		tempAccount *Account
+		accountData *models.Account
+		// registered are the devices to remove if a later step fails.
+		registered []*Account
+	)
+
+	register := func(acc **Account) func() error {
+		return func() error {
+			a, err := c.NewAccount(ctx)
+			if err != nil {
+				return err
+			}
+			*acc = a
+			registered = append(registered, a)
+			return nil
+		}
+	}
+	remove := func(acc **Account) func() error {
+		return func() error {
+			if err := c.RemoveDevice(ctx, *acc); err != nil {
+				return err
+			}
+			for i, a := range registered {
+				if a == *acc {
+					registered = append(registered[:i], registered[i+1:]...)
+					break
+				}
+			}
+			return nil
+		}
 	}
 
-	key := c.config.Keys[n.Int64()]
-	if err := c.ApplyKey(ctx, keyAccount, key); err != nil {
-		return nil, err
+	steps := []sagaStep{
+		{StepRegisterKeyDevice, register(&keyAccount)},
+		{StepRegisterTempDevice, register(&tempAccount)},
+		{StepAddReferrer, func() error { return c.AddReferrer(ctx, keyAccount, tempAccount) }},
+		{StepRemoveTempDevice, remove(&tempAccount)},
+		{StepApplyRandomKey, func() error {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(c.config.Keys)))) // [0; Length)
+			if err != nil {
+				n = big.NewInt(0)
+			}
+			return c.ApplyKey(ctx, keyAccount, c.config.Keys[n.Int64()])
+		}},
+		{StepRestoreLicense, func() error { return c.ApplyKey(ctx, keyAccount, keyAccount.Account.License) }},
+		{StepGetAccountData, func() (err error) {
+			accountData, err = c.GetAccountData(ctx, keyAccount)
+			return err
+		}},
+	}
+	if !keepDevice {
+		steps = append(steps, sagaStep{StepRemoveKeyDevice, remove(&keyAccount)})
 	}
 
-	if err := c.ApplyKey(ctx, keyAccount, keyAccount.Account.License); err != nil {
-		return nil, err
+	for _, s := range steps {
+		if err := s.run(); err != nil {
+			return nil, nil, &StepError{Step: s.step, Err: err, Cleanup: c.removeDevices(ctx, registered)}
+		}
+	}
+	if !keepDevice {
+		keyAccount = nil
 	}
 
-	accountData, err := c.GetAccountData(ctx, keyAccount)
-	if err != nil {
-		return nil, err
+	return accountData, keyAccount, nil
+}
+
+// cleanupTimeout limits the time spent removing the devices left behind by a failed NewAccountWithLicense.
+const cleanupTimeout = 30 * time.Second
+
+// removeDevices removes the devices in reverse order of registration and returns the joined errors.
+// It keeps going when ctx is canceled, otherwise a canceled request would leave the devices behind.
+func (c *Client) removeDevices(ctx context.Context, devices []*Account) error {
+	if len(devices) == 0 {
+		return nil
 	}
 
-	if err := c.RemoveDevice(ctx, keyAccount); err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(devices) - 1; i >= 0; i-- {
+		if err := c.RemoveDevice(ctx, devices[i]); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return accountData, nil
+	return errors.Join(errs...)
 }
 
 func (c *Client) logTiming(name string, start time.Time) {
+	d := time.Since(start)
+	if c.timing != nil {
+		c.timing(name, d)
+	}
 	if c.logging {
-		log.Trace().Str(name+"() took", time.Since(start).String()).Send()
+		log.Trace().Str(name+"() took", d.String()).Send()
 	}
 }
 
-func (c *Client) logError(err error) {
+// fail logs the error and returns it.
+func (c *Client) fail(err *Error) error {
 	if c.logging {
-		log.Err(err).Send()
+		log.Err(err).Str("op", err.Op).Int("status", err.StatusCode).Send()
 	}
+	return err
 }
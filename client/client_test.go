@@ -0,0 +1,246 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/client/clienttest"
+)
+
+func TestNewAccountWithLicenseStepErrors(t *testing.T) {
+	tests := []struct {
+		step     client.Step
+		endpoint string
+		fault    clienttest.Fault
+		sentinel error
+	}{
+		{
+			step:     client.StepRegisterKeyDevice,
+			endpoint: clienttest.EndpointRegister,
+			sentinel: client.ErrRegAccount,
+		},
+		{
+			step:     client.StepRegisterTempDevice,
+			endpoint: clienttest.EndpointRegister,
+			fault:    clienttest.Fault{After: 1},
+			sentinel: client.ErrRegAccount,
+		},
+		{
+			step:     client.StepAddReferrer,
+			endpoint: clienttest.EndpointAddReferrer,
+			sentinel: client.ErrUpdateAccount,
+		},
+		{
+			step:     client.StepRemoveTempDevice,
+			endpoint: clienttest.EndpointRemoveDevice,
+			fault:    clienttest.Fault{Times: 1},
+			sentinel: client.ErrUpdateAccount,
+		},
+		{
+			step:     client.StepApplyRandomKey,
+			endpoint: clienttest.EndpointApplyKey,
+			sentinel: client.ErrUpdateAccount,
+		},
+		{
+			step:     client.StepRestoreLicense,
+			endpoint: clienttest.EndpointApplyKey,
+			fault:    clienttest.Fault{After: 1},
+			sentinel: client.ErrUpdateAccount,
+		},
+		{
+			step:     client.StepGetAccountData,
+			endpoint: clienttest.EndpointAccount,
+			sentinel: client.ErrGetAccountData,
+		},
+		{
+			step:     client.StepRemoveKeyDevice,
+			endpoint: clienttest.EndpointRemoveDevice,
+			fault:    clienttest.Fault{After: 1, Times: 1},
+			sentinel: client.ErrUpdateAccount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.step), func(t *testing.T) {
+			fake := clienttest.NewServer()
+			defer fake.Close()
+
+			tt.fault.Status = http.StatusInternalServerError
+			fake.Inject(tt.endpoint, tt.fault)
+
+			acc, err := fake.Client().NewAccountWithLicense(context.Background())
+			if err == nil {
+				t.Fatalf("NewAccountWithLicense() = %+v, want an error", acc)
+			}
+
+			var stepErr *client.StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("error %v is not a *client.StepError", err)
+			}
+			if stepErr.Step != tt.step {
+				t.Errorf("Step = %q, want %q", stepErr.Step, tt.step)
+			}
+			if !errors.Is(err, tt.sentinel) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tt.sentinel)
+			}
+			if stepErr.Cleanup != nil {
+				t.Errorf("Cleanup = %v, want nil", stepErr.Cleanup)
+			}
+			if n := fake.Devices(); n != 0 {
+				t.Errorf("%d devices are left registered, want 0", n)
+			}
+		})
+	}
+}
+
+func TestNewAccountWithLicense(t *testing.T) {
+	fake := clienttest.NewServer()
+	defer fake.Close()
+
+	acc, err := fake.Client().NewAccountWithLicense(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.License == "" {
+		t.Error("License is empty")
+	}
+	if want := strconv.Itoa(clienttest.DefaultReferralBonus); acc.RefCount.String() != want {
+		t.Errorf("RefCount = %s, want %s", acc.RefCount, want)
+	}
+	if n := fake.Devices(); n != 0 {
+		t.Errorf("%d devices are left registered, want 0", n)
+	}
+}
+
+func TestNewDeviceWithLicense(t *testing.T) {
+	fake := clienttest.NewServer()
+	defer fake.Close()
+
+	acc, dev, err := fake.Client().NewDeviceWithLicense(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.Account.License != acc.License {
+		t.Errorf("device license = %q, want %q", dev.Account.License, acc.License)
+	}
+	if n := fake.Devices(); n != 1 {
+		t.Errorf("%d devices are registered, want the kept device only", n)
+	}
+
+	conf, err := dev.WireGuardConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"PrivateKey = " + dev.PrivateKey, "PublicKey = " + clienttest.PeerPublicKey, "Endpoint = " + clienttest.PeerEndpoint} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("config doesn't contain %q:\n%s", want, conf)
+		}
+	}
+}
+
+func TestDeviceCalls(t *testing.T) {
+	ctx := context.Background()
+	fake := clienttest.NewServer()
+	defer fake.Close()
+	c := fake.Client()
+
+	dev, err := c.NewAccount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := c.GetAccountData(ctx, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.License != dev.Account.License || acc.Type != "free" {
+		t.Errorf("GetAccountData() = %+v, want the free license %s of the device", acc, dev.Account.License)
+	}
+
+	donor, err := c.NewAccountWithLicense(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ApplyKey(ctx, dev, donor.License); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err = c.GetAccountData(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	if acc.License != donor.License || acc.RefCount != donor.RefCount {
+		t.Errorf("GetAccountData() after ApplyKey = %+v, want %+v", acc, donor)
+	}
+
+	if err := c.ApplyKey(ctx, dev, "invalid"); !errors.Is(err, client.ErrUpdateAccount) {
+		t.Errorf("ApplyKey() with an invalid license = %v, want ErrUpdateAccount", err)
+	}
+
+	if err := c.RemoveDevice(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Devices(); n != 0 {
+		t.Errorf("%d devices are registered, want 0", n)
+	}
+
+	_, err = c.GetAccountData(ctx, dev)
+	var ce *client.Error
+	if !errors.As(err, &ce) || !errors.Is(err, client.ErrGetAccountData) || ce.StatusCode != http.StatusNotFound {
+		t.Errorf("GetAccountData() of a removed device = %v, want ErrGetAccountData with status 404", err)
+	}
+	if err := c.RemoveDevice(ctx, dev); !errors.Is(err, client.ErrUpdateAccount) {
+		t.Errorf("RemoveDevice() of a removed device = %v, want ErrUpdateAccount", err)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	ctx := context.Background()
+	fake := clienttest.NewServer()
+	defer fake.Close()
+	c := fake.Client()
+
+	dev, err := c.NewAccount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Inject(clienttest.EndpointAccount, clienttest.Fault{Malformed: true})
+	_, err = c.GetAccountData(ctx, dev)
+	if !errors.Is(err, client.ErrDecodeAccount) {
+		t.Fatalf("GetAccountData() = %v, want ErrDecodeAccount", err)
+	}
+	var ce *client.Error
+	if !errors.As(err, &ce) || ce.StatusCode != http.StatusOK || ce.Body == "" || ce.Err == nil {
+		t.Errorf("error = %#v, want the status, the body and the decoding error", err)
+	}
+
+	fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Malformed: true})
+	if _, err := c.NewAccount(ctx); !errors.Is(err, client.ErrDecodeAccount) {
+		t.Errorf("NewAccount() = %v, want ErrDecodeAccount", err)
+	}
+}
+
+func TestLatencyBeyondDeadline(t *testing.T) {
+	fake := clienttest.NewServer()
+	defer fake.Close()
+	c := fake.Client()
+
+	fake.Inject(clienttest.AnyEndpoint, clienttest.Fault{Latency: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.NewAccountWithLicense(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("NewAccountWithLicense() = %v, want context.DeadlineExceeded", err)
+	}
+	if !errors.Is(err, client.ErrRegAccount) {
+		t.Errorf("errors.Is(%v, ErrRegAccount) = false", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the call took %s, want it to stop at the deadline", d)
+	}
+}
@@ -0,0 +1,396 @@
+// Package clienttest provides a fake of the upstream API used by client.Client,
+// so that the client and the server can be tested without network access.
+package clienttest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/handsomefox/gowarp/client"
+)
+
+// The endpoints of the fake, used to inject faults and count requests.
+const (
+	EndpointRegister     = "POST /reg"
+	EndpointAddReferrer  = "PATCH /reg/{id}"
+	EndpointRemoveDevice = "DELETE /reg/{id}"
+	EndpointApplyKey     = "PUT /reg/{id}/account"
+	EndpointAccount      = "GET /reg/{id}/account"
+
+	// AnyEndpoint injects a fault into every endpoint.
+	AnyEndpoint = "*"
+)
+
+// The peer returned to every registered device.
+const (
+	PeerPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+	PeerEndpoint  = "engage.example.com:2408"
+)
+
+// DefaultReferralBonus is the amount of GB a referral adds by default,
+// it is big enough for the generated keys to be accepted by the server's pool.
+const DefaultReferralBonus = 1000
+
+// Fault describes how the fake misbehaves on an endpoint.
+type Fault struct {
+	// Latency delays the response, or until the request is canceled.
+	Latency time.Duration
+	// Status makes the endpoint answer with this status and an error body instead of handling the request.
+	Status int
+	// Malformed makes the endpoint answer 200 with a body that is not valid JSON.
+	Malformed bool
+	// After is the amount of requests let through before the fault applies.
+	After int
+	// Times is the amount of requests the fault applies to, 0 means every request.
+	Times int
+}
+
+// Server is a fake upstream API backed by in-memory state.
+// It implements the endpoints used by client.Client:
+//
+//	POST   /reg               registers a device with a new free license and returns its WireGuard configuration
+//	PATCH  /reg/{id}          adds a referral to the account of the device
+//	DELETE /reg/{id}          removes the device
+//	PUT    /reg/{id}/account  binds the device to another existing license
+//	GET    /reg/{id}/account  returns the account of the device
+//
+// Every endpoint except the registration requires the token of the device.
+type Server struct {
+	*httptest.Server
+
+	// ReferralBonus is the amount of GB added to an account for every referral.
+	ReferralBonus int64
+
+	mu       sync.Mutex
+	devices  map[string]*device
+	accounts map[string]*account // by license
+	faults   map[string]*Fault
+	requests map[string]int
+	donorKey string
+	// registrations is the amount of registered devices, including the removed ones.
+	registrations int
+}
+
+type device struct {
+	id      string
+	token   string
+	key     string
+	license string
+	// addr is the last byte of the IPv4 address of the device inside the tunnel.
+	addr byte
+}
+
+type account struct {
+	license   string
+	typ       string
+	referrals int64
+}
+
+// NewServer starts a fake upstream. It must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		ReferralBonus: DefaultReferralBonus,
+		devices:       make(map[string]*device),
+		accounts:      make(map[string]*account),
+		faults:        make(map[string]*Fault),
+		requests:      make(map[string]int),
+	}
+	s.donorKey = s.newAccount("limited").license
+
+	r := chi.NewRouter()
+	r.Post("/reg", s.handle(EndpointRegister, s.register))
+	r.Patch("/reg/{id}", s.handle(EndpointAddReferrer, s.addReferrer))
+	r.Delete("/reg/{id}", s.handle(EndpointRemoveDevice, s.removeDevice))
+	r.Put("/reg/{id}/account", s.handle(EndpointApplyKey, s.applyKey))
+	r.Get("/reg/{id}/account", s.handle(EndpointAccount, s.account))
+	s.Server = httptest.NewServer(r)
+
+	return s
+}
+
+// Configuration returns a client configuration that points to the fake.
+func (s *Server) Configuration() client.ConfigurationData {
+	return client.ConfigurationData{
+		CFClientVersion: "a-6.3-1922",
+		UserAgent:       "okhttp/3.12.1",
+		Host:            strings.TrimPrefix(s.URL, "http://"),
+		BaseURL:         s.URL,
+		Keys:            []string{s.donorKey},
+		WaitTime:        time.Second,
+	}
+}
+
+// Client returns a client that talks to the fake.
+func (s *Server) Client(opts ...client.Option) *client.Client {
+	return client.NewClient(false, append([]client.Option{client.WithConfiguration(s.Configuration())}, opts...)...)
+}
+
+// Inject makes the endpoint misbehave as described by f, replacing the previous fault of the endpoint.
+func (s *Server) Inject(endpoint string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &f
+}
+
+// ClearFaults removes every injected fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.faults)
+}
+
+// Requests returns the amount of requests received by the endpoint, including the failed ones.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// Devices returns the amount of currently registered devices.
+func (s *Server) Devices() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.devices)
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request)
+
+// handle counts the request and applies the fault of the endpoint, if there is one.
+func (s *Server) handle(endpoint string, h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := s.takeFault(endpoint)
+		if f.Latency > 0 {
+			// The request is only canceled on a disconnect once its body was read.
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			t := time.NewTimer(f.Latency)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		switch {
+		case f.Status != 0:
+			writeError(w, f.Status, "injected fault")
+		case f.Malformed:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id": "malformed`))
+		default:
+			h(w, r)
+		}
+	}
+}
+
+func (s *Server) takeFault(endpoint string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[endpoint]++
+	for _, key := range []string{endpoint, AnyEndpoint} {
+		f, ok := s.faults[key]
+		if !ok {
+			continue
+		}
+		if f.After > 0 {
+			f.After--
+			return Fault{}
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				delete(s.faults, key)
+			}
+		}
+		return *f
+	}
+
+	return Fault{}
+}
+
+// newAccount creates an account with a random license, s.mu must be held.
+func (s *Server) newAccount(typ string) *account {
+	acc := &account{license: randomHex(8) + "-" + randomHex(8) + "-" + randomHex(8), typ: typ}
+	s.accounts[acc.license] = acc
+	return acc
+}
+
+// authorize returns the device of the request if the token matches, s.mu must be held.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*device, bool) {
+	d, ok := s.devices[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return nil, false
+	}
+	if r.Header.Get("Authorization") != "Bearer "+d.token {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return nil, false
+	}
+	return d, true
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.registrations++
+	d := &device{
+		id:      randomHex(16),
+		token:   randomHex(32),
+		key:     body.Key,
+		license: s.newAccount("free").license,
+		addr:    byte(s.registrations%250 + 2),
+	}
+	s.devices[d.id] = d
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":      d.id,
+		"token":   d.token,
+		"key":     d.key,
+		"account": s.accountJSON(s.accounts[d.license]),
+		"config": map[string]any{
+			"client_id": randomHex(4),
+			"peers": []map[string]any{{
+				"public_key": PeerPublicKey,
+				"endpoint": map[string]string{
+					"v4":   "127.0.0.1:0",
+					"v6":   "[::1]:0",
+					"host": PeerEndpoint,
+				},
+			}},
+			"interface": map[string]any{
+				"addresses": map[string]string{
+					"v4": fmt.Sprintf("172.16.0.%d", d.addr),
+					"v6": fmt.Sprintf("fd01:5ca1:ab1e::%x", d.addr),
+				},
+			},
+		},
+	})
+}
+
+func (s *Server) addReferrer(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Referrer string `json:"referrer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if _, ok := s.devices[body.Referrer]; !ok {
+		writeError(w, http.StatusBadRequest, "unknown referrer")
+		return
+	}
+
+	acc := s.accounts[d.license]
+	acc.referrals += s.ReferralBonus
+	writeJSON(w, http.StatusOK, s.accountJSON(acc))
+}
+
+func (s *Server) removeDevice(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	delete(s.devices, d.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) applyKey(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		License string `json:"license"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	acc, ok := s.accounts[body.License]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid license")
+		return
+	}
+
+	d.license = acc.license
+	writeJSON(w, http.StatusOK, s.accountJSON(acc))
+}
+
+func (s *Server) account(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.accountJSON(s.accounts[d.license]))
+}
+
+func (s *Server) accountJSON(acc *account) map[string]any {
+	return map[string]any{
+		"account_type":   acc.typ,
+		"referral_count": acc.referrals,
+		"license":        acc.license,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{
+		"success": false,
+		"errors":  []map[string]any{{"code": status, "message": msg}},
+	})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n/2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,29 +1,204 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidConfiguration  = errors.New("client: invalid configuration")
+	ErrConfigurationNotFound = errors.New("client: no configuration file or GOWARP_* environment variables found")
 )
 
 // ConfigurationData is the configuration required for the client to work.
 type ConfigurationData struct {
-	CFClientVersion string
-	UserAgent       string
-	Host            string
-	BaseURL         string
-	Keys            []string
-	WaitTime        time.Duration
+	CFClientVersion string        `yaml:"cf_client_version"`
+	UserAgent       string        `yaml:"user_agent"`
+	Host            string        `yaml:"host"`
+	BaseURL         string        `yaml:"base_url"`
+	Keys            []string      `yaml:"keys"`
+	WaitTime        time.Duration `yaml:"wait_time"`
+}
+
+// defaultWaitTime is used when the configuration doesn't set the WaitTime.
+const defaultWaitTime = 45 * time.Second
+
+// envPrefix is the prefix of the environment variables read by ConfigurationFromEnv.
+const envPrefix = "GOWARP_"
+
+// envNames maps the fields of ConfigurationData to the environment variables read by ConfigurationFromEnv.
+var envNames = map[string]string{
+	"CFClientVersion": envPrefix + "CF_CLIENT_VERSION",
+	"UserAgent":       envPrefix + "USER_AGENT",
+	"Host":            envPrefix + "HOST",
+	"BaseURL":         envPrefix + "BASE_URL",
+	"Keys":            envPrefix + "KEYS",
+	"WaitTime":        envPrefix + "WAIT_TIME",
 }
 
-// GetConfiguration returns a new configuration parsed from the url, or an error if it fails to parse.
+// yamlNames maps the fields of ConfigurationData to the keys read by ConfigurationFromFile.
+var yamlNames = map[string]string{
+	"CFClientVersion": "cf_client_version",
+	"UserAgent":       "user_agent",
+	"Host":            "host",
+	"BaseURL":         "base_url",
+	"Keys":            "keys",
+}
+
+// LoadConfiguration reads the configuration from the YAML file at path,
+// or from the GOWARP_* environment variables if the path is empty.
+// It returns ErrConfigurationNotFound if the path is empty and none of the variables are set.
+func LoadConfiguration(path string) (ConfigurationData, error) {
+	if path != "" {
+		return ConfigurationFromFile(path)
+	}
+	return ConfigurationFromEnv()
+}
+
+// ConfigurationFromFile reads and validates the configuration from a YAML file, e.g.
+//
+//	cf_client_version: a-6.3-1922
+//	user_agent: okhttp/3.12.1
+//	host: api.example.com
+//	base_url: https://api.example.com/v0a1922
+//	keys:
+//	  - xxxxxxxx-xxxxxxxx-xxxxxxxx
+//	wait_time: 45s
+func ConfigurationFromFile(path string) (ConfigurationData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ConfigurationData{}, fmt.Errorf("client: reading the configuration: %w", err)
+	}
+
+	var cfg ConfigurationData
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return ConfigurationData{}, fmt.Errorf("%w: %s: %w", ErrInvalidConfiguration, path, err)
+	}
+	cfg.Keys = cleanKeys(cfg.Keys)
+	if cfg.WaitTime == 0 {
+		cfg.WaitTime = defaultWaitTime
+	}
+
+	if missing := cfg.missing(); len(missing) > 0 {
+		return ConfigurationData{}, fmt.Errorf("%s: %w", path, missingError(missing, yamlNames))
+	}
+
+	return cfg, nil
+}
+
+// ConfigurationFromEnv reads and validates the configuration from the GOWARP_* environment variables:
+// GOWARP_CF_CLIENT_VERSION, GOWARP_USER_AGENT, GOWARP_HOST, GOWARP_BASE_URL,
+// GOWARP_KEYS (comma-separated) and the optional GOWARP_WAIT_TIME.
+func ConfigurationFromEnv() (ConfigurationData, error) {
+	found := false
+	get := func(field string) string {
+		v, ok := os.LookupEnv(envNames[field])
+		found = found || ok
+		return v
+	}
+
+	cfg := ConfigurationData{
+		CFClientVersion: get("CFClientVersion"),
+		UserAgent:       get("UserAgent"),
+		Host:            get("Host"),
+		BaseURL:         get("BaseURL"),
+		Keys:            splitKeys(get("Keys")),
+		WaitTime:        defaultWaitTime,
+	}
+	if wt := get("WaitTime"); wt != "" {
+		d, err := time.ParseDuration(wt)
+		if err != nil {
+			return ConfigurationData{}, fmt.Errorf("%w: %s: %w", ErrInvalidConfiguration, envNames["WaitTime"], err)
+		}
+		cfg.WaitTime = d
+	}
+
+	if !found {
+		return ConfigurationData{}, ErrConfigurationNotFound
+	}
+
+	if missing := cfg.missing(); len(missing) > 0 {
+		return ConfigurationData{}, missingError(missing, envNames)
+	}
+
+	return cfg, nil
+}
+
+// splitKeys splits the comma-separated keys, dropping the blank ones.
+func splitKeys(s string) []string {
+	return cleanKeys(strings.Split(s, ","))
+}
+
+// cleanKeys returns a copy of the keys with the surrounding spaces trimmed and the blank ones dropped,
+// a blank key would otherwise be picked by NewAccountWithLicense sooner or later.
+func cleanKeys(keys []string) []string {
+	var clean []string
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			clean = append(clean, k)
+		}
+	}
+	return clean
+}
+
+// GetConfiguration returns a new configuration read from the CFClientVersion, UserAgent,
+// Host, BaseURL and Keys environment variables.
+//
+// Deprecated: the unprefixed variables clash with other software, use LoadConfiguration instead.
 func GetConfiguration() *ConfigurationData {
 	return &ConfigurationData{
 		CFClientVersion: os.Getenv("CFClientVersion"),
 		UserAgent:       os.Getenv("UserAgent"),
 		Host:            os.Getenv("Host"),
 		BaseURL:         os.Getenv("BaseURL"),
-		Keys:            strings.Split(os.Getenv("Keys"), ","),
-		WaitTime:        45 * time.Second,
+		Keys:            splitKeys(os.Getenv("Keys")),
+		WaitTime:        defaultWaitTime,
 	}
 }
+
+// Validate returns ErrInvalidConfiguration listing the missing fields, if there are any.
+func (cd *ConfigurationData) Validate() error {
+	if missing := cd.missing(); len(missing) > 0 {
+		return missingError(missing, nil)
+	}
+	return nil
+}
+
+// missingError returns ErrInvalidConfiguration listing the missing fields under their names in the source.
+func missingError(missing []string, names map[string]string) error {
+	for i, field := range missing {
+		if name, ok := names[field]; ok {
+			missing[i] = name
+		}
+	}
+	return fmt.Errorf("%w: missing %s", ErrInvalidConfiguration, strings.Join(missing, ", "))
+}
+
+// missing returns the names of the required fields that are empty.
+func (cd *ConfigurationData) missing() []string {
+	var missing []string
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"CFClientVersion", cd.CFClientVersion},
+		{"UserAgent", cd.UserAgent},
+		{"Host", cd.Host},
+		{"BaseURL", cd.BaseURL},
+	} {
+		if strings.TrimSpace(f.value) == "" {
+			missing = append(missing, f.name)
+		}
+	}
+
+	if len(cleanKeys(cd.Keys)) == 0 {
+		missing = append(missing, "Keys")
+	}
+
+	return missing
+}
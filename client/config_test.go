@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testConfigYAML = `cf_client_version: a-6.3-1922
+user_agent: okhttp/3.12.1
+host: api.example.com
+base_url: https://api.example.com/v0a1922
+`
+
+func TestConfigurationFromFileKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		want    []string
+		invalid bool
+	}{
+		{name: "keys", keys: "keys: [a, b]", want: []string{"a", "b"}},
+		{name: "blank keys are dropped", keys: `keys: ["", " a ", "  "]`, want: []string{"a"}},
+		{name: "only blank keys", keys: `keys: ["", " "]`, invalid: true},
+		{name: "no keys", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(testConfigYAML+tt.keys+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := ConfigurationFromFile(path)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidConfiguration) {
+					t.Fatalf("ConfigurationFromFile() error = %v, want ErrInvalidConfiguration", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.Keys, tt.want) {
+				t.Errorf("Keys = %q, want %q", cfg.Keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientWithConfigKeys(t *testing.T) {
+	cfg := ConfigurationData{
+		CFClientVersion: "a-6.3-1922",
+		UserAgent:       "okhttp/3.12.1",
+		Host:            "api.example.com",
+		BaseURL:         "https://api.example.com/v0a1922",
+		Keys:            []string{"", " "},
+	}
+	if _, err := NewClientWithConfig(cfg); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Fatalf("NewClientWithConfig() with blank keys error = %v, want ErrInvalidConfiguration", err)
+	}
+
+	cfg.Keys = []string{"", "a"}
+	c, err := NewClientWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.config.Keys, []string{"a"}) {
+		t.Errorf("Keys = %q, want the blank key dropped", c.config.Keys)
+	}
+}
@@ -1,6 +1,12 @@
 package client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
 
 var (
 	ErrRegAccount            = errors.New("client: failed to register an account")
@@ -10,3 +16,103 @@ var (
 	ErrGetAccountData        = errors.New("client: failed to get the account data")
 	ErrFetchingConfiguration = errors.New("client: error fetching configuration")
 )
+
+// maxSnippetLen is the maximum length of the response body kept in an Error.
+const maxSnippetLen = 256
+
+// Error is returned by the methods of Client when a call to the upstream API fails.
+//
+// It matches the sentinel error in Kind, e.g. errors.Is(err, ErrRegAccount),
+// and unwraps to the underlying cause, if there is one.
+type Error struct {
+	// Op is the name of the method that failed, e.g. "NewAccount".
+	Op string
+	// Kind is one of the sentinel errors of the package.
+	Kind error
+	// StatusCode is the HTTP status of the response, or 0 if there was no response.
+	StatusCode int
+	// Body is the beginning of the response body, if there was a response.
+	Body string
+	// Err is the underlying cause, it is nil if the request failed only because of the status.
+	Err error
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	sb.WriteString("client: ")
+	sb.WriteString(e.Op)
+	if e.Kind != nil {
+		sb.WriteString(": ")
+		sb.WriteString(strings.TrimPrefix(e.Kind.Error(), "client: "))
+	}
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&sb, ": status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.Body != "" {
+		fmt.Fprintf(&sb, ": body %q", e.Body)
+	}
+	if e.Err != nil {
+		sb.WriteString(": ")
+		sb.WriteString(e.Err.Error())
+	}
+	return sb.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error in Kind.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// snippet returns the beginning of the body, cut at maxSnippetLen bytes without splitting a rune.
+func snippet(body []byte) string {
+	if len(body) <= maxSnippetLen {
+		return strings.TrimSpace(string(body))
+	}
+	body = body[:maxSnippetLen]
+	for len(body) > 0 && !utf8.Valid(body) {
+		body = body[:len(body)-1]
+	}
+	return strings.TrimSpace(string(body)) + "..."
+}
+
+// Step is a step of NewAccountWithLicense or NewDevice.
+type Step string
+
+const (
+	StepRegisterKeyDevice  Step = "register key device"
+	StepRegisterTempDevice Step = "register temporary device"
+	StepAddReferrer        Step = "add referrer"
+	StepRemoveTempDevice   Step = "remove temporary device"
+	StepApplyRandomKey     Step = "apply random key"
+	StepRestoreLicense     Step = "restore license"
+	StepGetAccountData     Step = "get account data"
+	StepRemoveKeyDevice    Step = "remove key device"
+	StepApplyKey           Step = "apply key"
+)
+
+// StepError is returned by NewAccountWithLicense and NewDevice when one of their steps fails.
+// It unwraps to the error of the step, so it matches the same sentinels.
+type StepError struct {
+	// Step is the step that failed.
+	Step Step
+	// Err is the error returned by the step.
+	Err error
+	// Cleanup is the error of removing the devices registered before the failure, nil if it succeeded.
+	Cleanup error
+}
+
+func (e *StepError) Error() string {
+	msg := "client: " + string(e.Step) + " failed: " + e.Err.Error()
+	if e.Cleanup != nil {
+		msg += " (cleanup failed: " + e.Cleanup.Error() + ")"
+	}
+	return msg
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "op only",
+			err:  &Error{Op: "NewAccount"},
+			want: "client: NewAccount",
+		},
+		{
+			name: "status and body",
+			err:  &Error{Op: "NewAccount", Kind: ErrRegAccount, StatusCode: http.StatusInternalServerError, Body: `{"error":"oops"}`},
+			want: `client: NewAccount: failed to register an account: status 500 Internal Server Error: body "{\"error\":\"oops\"}"`,
+		},
+		{
+			name: "cause",
+			err:  &Error{Op: "GetAccountData", Kind: ErrGetAccountData, Err: io.ErrUnexpectedEOF},
+			want: "client: GetAccountData: failed to get the account data: unexpected EOF",
+		},
+		{
+			name: "step",
+			err:  &StepError{Step: StepAddReferrer, Err: &Error{Op: "AddReferrer", Kind: ErrUpdateAccount, StatusCode: http.StatusTooManyRequests}},
+			want: "client: add referrer failed: client: AddReferrer: failed to update the account data: status 429 Too Many Requests",
+		},
+		{
+			name: "step with a failed cleanup",
+			err:  &StepError{Step: StepApplyKey, Err: io.EOF, Cleanup: errors.New("device gone")},
+			want: "client: apply key failed: EOF (cleanup failed: device gone)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("a", maxSnippetLen)
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "empty", body: "", want: ""},
+		{name: "short", body: "  not found\n", want: "not found"},
+		{name: "at the limit", body: long, want: long},
+		{name: "too long", body: long + "bbb", want: long + "..."},
+		{
+			name: "rune at the limit",
+			body: long[1:] + "é and more",
+			want: long[1:] + "...",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := snippet([]byte(tt.body))
+			if got != tt.want {
+				t.Errorf("snippet() = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("snippet() = %q is not valid UTF-8", got)
+			}
+		})
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	cause := io.ErrUnexpectedEOF
+	apiErr := &Error{Op: "GetAccountData", Kind: ErrGetAccountData, StatusCode: http.StatusBadGateway, Err: cause}
+	err := &StepError{Step: StepGetAccountData, Err: apiErr}
+
+	if !errors.Is(err, ErrGetAccountData) {
+		t.Error("errors.Is(err, ErrGetAccountData) = false, want the kind matched")
+	}
+	if errors.Is(err, ErrRegAccount) {
+		t.Error("errors.Is(err, ErrRegAccount) = true, want only the kind matched")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is(err, cause) = false, want the cause unwrapped")
+	}
+	if errors.Unwrap(apiErr) != cause {
+		t.Errorf("Unwrap() = %v, want the cause", errors.Unwrap(apiErr))
+	}
+	if errors.Unwrap(&Error{Op: "NewAccount", Kind: ErrRegAccount}) != nil {
+		t.Error("Unwrap() of a status error is not nil")
+	}
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != StepGetAccountData {
+		t.Errorf("errors.As(*StepError) = %v, want the step error", stepErr)
+	}
+	var target *Error
+	if !errors.As(err, &target) || target.StatusCode != http.StatusBadGateway {
+		t.Errorf("errors.As(*Error) = %v, want the error of the step", target)
+	}
+}
@@ -7,4 +7,38 @@ type Account struct {
 		License string `json:"license"`
 	} `json:"account"`
 	Token string `json:"token"`
+	// Key is the public key of the device, sent on registration.
+	Key string `json:"key"`
+	// PrivateKey is the private key of the device, it never leaves the client.
+	PrivateKey string `json:"-"`
+	// Config is the WireGuard configuration assigned to the device.
+	Config DeviceConfig `json:"config"`
+}
+
+// DeviceConfig is the WireGuard configuration returned on registration.
+type DeviceConfig struct {
+	ClientID  string `json:"client_id"`
+	Peers     []Peer `json:"peers"`
+	Interface struct {
+		Addresses Addresses `json:"addresses"`
+	} `json:"interface"`
+}
+
+// Peer is a WireGuard peer of the device.
+type Peer struct {
+	PublicKey string   `json:"public_key"`
+	Endpoint  Endpoint `json:"endpoint"`
+}
+
+// Endpoint is the address of a peer, Host is a host:port, V4 and V6 are IP addresses with a port.
+type Endpoint struct {
+	V4   string `json:"v4"`
+	V6   string `json:"v6"`
+	Host string `json:"host"`
+}
+
+// Addresses are the addresses of the device inside the tunnel.
+type Addresses struct {
+	V4 string `json:"v4"`
+	V6 string `json:"v6"`
 }
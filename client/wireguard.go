@@ -0,0 +1,91 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrNoWireGuardConfig = errors.New("client: the account has no WireGuard configuration")
+
+// KeyPair is a Curve25519 key pair of a WireGuard device, both keys are base64 encoded.
+type KeyPair struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+// GenerateKeyPair generates a new Curve25519 key pair for a device.
+func GenerateKeyPair() (KeyPair, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("client: generating the key pair: %w", err)
+	}
+
+	return KeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(key.Bytes()),
+		PublicKey:  base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+	}, nil
+}
+
+// The defaults of the rendered configuration, they match the official client.
+var (
+	wireGuardDNS        = []string{"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"}
+	wireGuardAllowedIPs = []string{"0.0.0.0/0", "::/0"}
+)
+
+const wireGuardMTU = 1280
+
+// WireGuardConfig renders a standard WireGuard .conf for the device of the account.
+// It returns ErrNoWireGuardConfig if the account was not registered by this client,
+// so there is no private key, or if the registration didn't return a peer.
+func (a *Account) WireGuardConfig() (string, error) {
+	if a.PrivateKey == "" || len(a.Config.Peers) == 0 {
+		return "", ErrNoWireGuardConfig
+	}
+
+	var addrs []string
+	if v4 := a.Config.Interface.Addresses.V4; v4 != "" {
+		addrs = append(addrs, v4+"/32")
+	}
+	if v6 := a.Config.Interface.Addresses.V6; v6 != "" {
+		addrs = append(addrs, v6+"/128")
+	}
+	if len(addrs) == 0 {
+		return "", ErrNoWireGuardConfig
+	}
+
+	var sb strings.Builder
+	sb.WriteString("[Interface]\n")
+	fmt.Fprintf(&sb, "PrivateKey = %s\n", a.PrivateKey)
+	fmt.Fprintf(&sb, "Address = %s\n", strings.Join(addrs, ", "))
+	fmt.Fprintf(&sb, "DNS = %s\n", strings.Join(wireGuardDNS, ", "))
+	fmt.Fprintf(&sb, "MTU = %d\n", wireGuardMTU)
+
+	for _, p := range a.Config.Peers {
+		sb.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&sb, "PublicKey = %s\n", p.PublicKey)
+		fmt.Fprintf(&sb, "AllowedIPs = %s\n", strings.Join(wireGuardAllowedIPs, ", "))
+		if ep := p.Endpoint.endpoint(); ep != "" {
+			fmt.Fprintf(&sb, "Endpoint = %s\n", ep)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// endpoint prefers the host name, the IP addresses are returned with port 0 by the API.
+func (e Endpoint) endpoint() string {
+	if e.Host != "" {
+		return e.Host
+	}
+	for _, addr := range []string{e.V4, e.V6} {
+		if host, port, err := net.SplitHostPort(addr); err == nil && port != "0" {
+			return net.JoinHostPort(host, port)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const accountsUsage = `Usage: gowarp-cli accounts <command> [arguments]
+
+Commands:
+  list [-output text|json]         list the registered devices
+  show [-output text|json] ID      show a registered device
+  refresh [-output text|json] ID   update the account data of the device from the upstream
+  delete [-local] ID               remove the device, -local only forgets it
+`
+
+// runAccounts implements the "accounts" subcommand used to manage the local store.
+func runAccounts(ctx context.Context, e *env, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, accountsUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return runAccountsList(e, args[1:], out)
+	case "show":
+		return runAccountsShow(e, args[1:], out)
+	case "refresh":
+		return runAccountsRefresh(ctx, e, args[1:], out)
+	case "delete":
+		return runAccountsDelete(ctx, e, args[1:])
+	case "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, accountsUsage)
+		return errHelp
+	default:
+		fmt.Fprint(os.Stderr, accountsUsage)
+		return errUsage
+	}
+}
+
+func runAccountsList(e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("accounts list", "[-output text|json]")
+	output := outputFlag(fs)
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := checkOutput(fs, *output); err != nil {
+		return err
+	}
+
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		if store.Accounts == nil {
+			store.Accounts = []StoredAccount{}
+		}
+		return writeJSON(out, store.Accounts)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLICENSE\tTYPE\tREFERRAL COUNT (GB)\tCREATED\tREFRESHED")
+	for _, a := range store.Accounts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", orDash(a.ID), a.License, orDash(a.Type), orDash(a.RefCount.String()),
+			a.CreatedAt.Local().Format(time.DateTime), a.RefreshedAt.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func runAccountsShow(e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("accounts show", "[-output text|json] ID")
+	output := outputFlag(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if err := checkOutput(fs, *output); err != nil {
+		return err
+	}
+
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+	acc, err := store.Get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return writeStoredAccount(out, *output, acc)
+}
+
+func runAccountsRefresh(ctx context.Context, e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("accounts refresh", "[-output text|json] ID")
+	output := outputFlag(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if err := checkOutput(fs, *output); err != nil {
+		return err
+	}
+
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+	acc, err := store.Get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !acc.hasDevice() {
+		return fmt.Errorf("the device of %s is registered by %s, it can't be refreshed", acc.License, acc.Server)
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	data, err := c.GetAccountData(ctx, acc.device())
+	if err != nil {
+		return err
+	}
+	acc.update(data)
+	if err := store.Save(); err != nil {
+		return err
+	}
+
+	return writeStoredAccount(out, *output, acc)
+}
+
+func runAccountsDelete(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("accounts delete", "[-local] ID")
+	local := fs.Bool("local", false, "only forget the device, without removing it from the upstream")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+	acc, err := store.Get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *local:
+	case !acc.hasDevice():
+		log.Info().Str("server", acc.Server).Msg("the device is registered by the server, only forgetting it")
+	default:
+		c, err := e.client()
+		if err != nil {
+			return err
+		}
+		if err := c.RemoveDevice(ctx, acc.device()); err != nil {
+			return fmt.Errorf("%w (use -local to only forget it)", err)
+		}
+		log.Info().Str("id", acc.ID).Msg("removed the device")
+	}
+
+	if err := store.Remove(acc.key()); err != nil {
+		return err
+	}
+	return store.Save()
+}
+
+// writeStoredAccount prints the account as lines of text or a JSON object, the secrets are only in the JSON.
+func writeStoredAccount(out io.Writer, output string, acc *StoredAccount) error {
+	if output == "json" {
+		return writeJSON(out, acc)
+	}
+	_, err := fmt.Fprintf(out,
+		"ID:                  %s\nLicense:             %s\nLicense type:        %s\nReferral count (GB): %s\nCreated:             %s\nRefreshed:           %s\n",
+		orDash(acc.ID), acc.License, orDash(acc.Type), orDash(acc.RefCount.String()),
+		acc.CreatedAt.Local().Format(time.DateTime), acc.RefreshedAt.Local().Format(time.DateTime))
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
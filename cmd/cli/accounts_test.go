@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/handsomefox/gowarp/client/clienttest"
+)
+
+// generate generates the keys with the fake upstream and returns the stored accounts.
+func (c *testCLI) generate(t *testing.T, count int) []StoredAccount {
+	t.Helper()
+
+	if code, _ := c.run(t, "generate", "-count", strconv.Itoa(count)); code != exitOK {
+		t.Fatalf("generate exit code = %d, want %d", code, exitOK)
+	}
+	accounts := c.accounts(t)
+	if len(accounts) != count {
+		t.Fatalf("%d accounts are stored, want %d", len(accounts), count)
+	}
+	return accounts
+}
+
+func TestAccountsList(t *testing.T) {
+	cli := newTestCLI(t)
+
+	code, out := cli.run(t, "accounts", "list", "-output", "json")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	if strings.TrimSpace(out) != "[]" {
+		t.Errorf("output of an empty store = %q, want an empty array", out)
+	}
+
+	newUpstream(t)
+	stored := cli.generate(t, 2)
+
+	code, out = cli.run(t, "accounts", "list", "-output", "json")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	var listed []StoredAccount
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out, err)
+	}
+	if len(listed) != len(stored) {
+		t.Fatalf("listed %d accounts, want %d", len(listed), len(stored))
+	}
+	for i := range listed {
+		if listed[i].ID != stored[i].ID || listed[i].Token != stored[i].Token || listed[i].License != stored[i].License {
+			t.Errorf("listed account = %+v, want %+v", listed[i], stored[i])
+		}
+	}
+
+	code, out = cli.run(t, "accounts", "list")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("text output = %q, want a header and 2 rows", out)
+	}
+	for i, acc := range stored {
+		if !strings.HasPrefix(lines[i+1], acc.ID+" ") || !strings.Contains(lines[i+1], acc.License) {
+			t.Errorf("row %q, want the id %s and the license %s", lines[i+1], acc.ID, acc.License)
+		}
+		if strings.Contains(out, acc.Token) || strings.Contains(out, acc.PrivateKey) {
+			t.Error("the text output contains the secrets of the device")
+		}
+	}
+}
+
+func TestAccountsRefresh(t *testing.T) {
+	cli := newTestCLI(t)
+	newUpstream(t)
+	stored := cli.generate(t, 2)
+	dev, key := stored[0], stored[1]
+
+	// The license of the device changes on the upstream, the local store doesn't know yet.
+	if code, _ := cli.run(t, "apply-key", dev.ID, dev.Token, key.License); code != exitOK {
+		t.Fatalf("apply-key exit code = %d, want %d", code, exitOK)
+	}
+
+	code, out := cli.run(t, "accounts", "refresh", "-output", "json", dev.ID)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	var refreshed StoredAccount
+	if err := json.Unmarshal([]byte(out), &refreshed); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out, err)
+	}
+	if refreshed.License != key.License || refreshed.RefCount != key.RefCount || refreshed.Type != key.Type {
+		t.Errorf("refreshed account = %+v, want the data of %s", refreshed, key.License)
+	}
+	if !refreshed.RefreshedAt.After(dev.RefreshedAt) {
+		t.Errorf("RefreshedAt = %s, want after %s", refreshed.RefreshedAt, dev.RefreshedAt)
+	}
+
+	acc := cli.accounts(t)[0]
+	if acc.ID != dev.ID || acc.License != key.License || !acc.RefreshedAt.Equal(refreshed.RefreshedAt) {
+		t.Errorf("stored account = %+v, want the refreshed data saved", acc)
+	}
+}
+
+func TestAccountsRefreshFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    func(acc StoredAccount) string
+		fault bool
+	}{
+		{name: "unknown id", id: func(StoredAccount) string { return "unknown" }},
+		{name: "upstream failure", id: func(acc StoredAccount) string { return acc.ID }, fault: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := newTestCLI(t)
+			fake := newUpstream(t)
+			acc := cli.generate(t, 1)[0]
+			if tt.fault {
+				fake.Inject(clienttest.EndpointAccount, clienttest.Fault{Status: http.StatusInternalServerError})
+			}
+
+			if code, _ := cli.run(t, "accounts", "refresh", tt.id(acc)); code != exitFailure {
+				t.Errorf("exit code = %d, want %d", code, exitFailure)
+			}
+			if got := cli.accounts(t)[0]; !got.RefreshedAt.Equal(acc.RefreshedAt) {
+				t.Errorf("stored account = %+v, want it unchanged", got)
+			}
+		})
+	}
+}
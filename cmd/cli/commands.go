@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/handsomefox/gowarp/apiclient"
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// newFlagSet returns a flag set that prints the usage line of the command on errors.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gowarp-cli %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags and checks the amount of positional arguments.
+// It returns errHelp for -h, so a command exits like gowarp-cli -h.
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return errHelp
+		}
+		return errUsage
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// outputFlag adds the -output flag, which is checked by checkOutput.
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "text", "output format, text or json")
+}
+
+func checkOutput(fs *flag.FlagSet, output string) error {
+	if output != "text" && output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %q\n", output)
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// AccountOutput is the printed representation of an account.
+type AccountOutput struct {
+	License  string      `json:"license"`
+	Type     string      `json:"account_type"`
+	RefCount json.Number `json:"referral_count"`
+}
+
+func newAccountOutput(acc *models.Account) AccountOutput {
+	return AccountOutput{License: acc.License, Type: acc.Type, RefCount: acc.RefCount}
+}
+
+// writeAccounts prints the accounts as a table or a JSON array.
+func writeAccounts(out io.Writer, output string, accounts []AccountOutput) error {
+	if output == "json" {
+		if accounts == nil {
+			accounts = []AccountOutput{}
+		}
+		return writeJSON(out, accounts)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LICENSE\tTYPE\tREFERRAL COUNT (GB)")
+	for _, a := range accounts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", a.License, a.Type, a.RefCount)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runGenerate(ctx context.Context, e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("generate", "[-count N] [-output text|json] [-min-refcount N] [-wireguard PATH]")
+	count := fs.Int("count", 1, "amount of keys to generate")
+	output := outputFlag(fs)
+	minRefCount := fs.Int64("min-refcount", 1000, "minimum referral count (GB) of a usable key")
+	wgPath := fs.String("wireguard", "",
+		"write the WireGuard config of the device holding the generated key to the file, - for stdout; requires -count 1")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := checkOutput(fs, *output); err != nil {
+		return err
+	}
+	if *count < 1 || (*wgPath != "" && *count != 1) {
+		fs.Usage()
+		return errUsage
+	}
+
+	generate, err := e.generator(*wgPath != "")
+	if err != nil {
+		return err
+	}
+	// Load the store first, so the generated devices are never lost.
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+
+	var (
+		accounts []AccountOutput
+		keys     []*generated
+		failed   int
+	)
+	for i := 0; i < *count && ctx.Err() == nil; i++ {
+		g, err := generate(ctx)
+		if err != nil {
+			log.Err(err).Msg("failed to create an account")
+			failed++
+			if isPermanent(err) {
+				// Every next request would fail the same way.
+				failed += *count - i - 1
+				break
+			}
+			continue
+		}
+
+		rc, err := g.acc.RefCount.Int64()
+		if err != nil || rc < *minRefCount {
+			log.Error().Err(err).Str("ref_count", g.acc.RefCount.String()).Msg("generated key is too small to use")
+			if g.dev != nil {
+				if err := e.c.RemoveDevice(ctx, g.dev); err != nil {
+					log.Err(err).Str("id", g.dev.ID).Msg("failed to remove the device of the unusable key")
+				}
+			}
+			failed++
+			continue
+		}
+
+		accounts = append(accounts, newAccountOutput(g.acc))
+		if g.dev == nil {
+			log.Debug().Int("n", len(accounts)).Msg("got a key from the server")
+			store.Add(newServerAccount(e.server, g.acc, g.conf))
+		} else {
+			log.Debug().Int("n", len(accounts)).Str("id", g.dev.ID).Msg("generated a key")
+			store.Add(newStoredAccount(g.dev, g.acc))
+		}
+		keys = append(keys, g)
+	}
+
+	if len(keys) > 0 {
+		if err := store.Save(); err != nil {
+			return err
+		}
+	}
+
+	if err := writeAccounts(out, *output, accounts); err != nil {
+		return err
+	}
+
+	if *wgPath != "" && len(keys) == 1 {
+		if err := writeWireGuardConfig(keys[0].wireGuardConfig, *wgPath, out); err != nil {
+			return fmt.Errorf("failed to create the WireGuard config: %w", err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to generate %d of %d keys", failed, *count)
+	}
+
+	return nil
+}
+
+// generated is a key returned by a generateFunc. A key generated locally comes with the
+// device holding it, a key from the server only with the WireGuard config, if requested.
+type generated struct {
+	acc  *models.Account
+	dev  *client.Account
+	conf string
+}
+
+// wireGuardConfig returns the WireGuard config of the device holding the key.
+func (g *generated) wireGuardConfig() (string, error) {
+	if g.dev != nil {
+		return g.dev.WireGuardConfig()
+	}
+	if g.conf == "" {
+		return "", client.ErrNoWireGuardConfig
+	}
+	return g.conf, nil
+}
+
+// generateFunc returns a new key.
+type generateFunc func(ctx context.Context) (*generated, error)
+
+// generator returns the source of the keys of generate: the upstream API, or the gowarp server
+// if -server is set. With wireGuard, the server also registers a device and returns its config.
+func (e *env) generator(wireGuard bool) (generateFunc, error) {
+	if e.server != "" {
+		api := apiclient.New(e.server, apiclient.WithToken(e.token))
+		return func(ctx context.Context) (*generated, error) {
+			if wireGuard {
+				conf, err := api.CreateConfig(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return &generated{acc: serverAccount(&conf.Key), conf: conf.Config}, nil
+			}
+			key, err := api.CreateKey(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &generated{acc: serverAccount(key)}, nil
+		}, nil
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) (*generated, error) {
+		acc, dev, err := c.NewDeviceWithLicense(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &generated{acc: acc, dev: dev}, nil
+	}, nil
+}
+
+func serverAccount(key *apiclient.Key) *models.Account {
+	return &models.Account{License: key.License, Type: key.Type, RefCount: key.RefCount}
+}
+
+// isPermanent reports whether the server refused the request in a way that retrying won't fix.
+func isPermanent(err error) bool {
+	var ae *apiclient.Error
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.Status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+func runInfo(ctx context.Context, e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("info", "[-output text|json] ID TOKEN")
+	output := outputFlag(fs)
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	if err := checkOutput(fs, *output); err != nil {
+		return err
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	acc, err := c.GetAccountData(ctx, &client.Account{ID: fs.Arg(0), Token: fs.Arg(1)})
+	if err != nil {
+		return err
+	}
+
+	return writeAccount(out, *output, newAccountOutput(acc))
+}
+
+// writeAccount prints a single account as lines of text or a JSON object.
+func writeAccount(out io.Writer, output string, acc AccountOutput) error {
+	if output == "json" {
+		return writeJSON(out, acc)
+	}
+	_, err := fmt.Fprintf(out, "License:             %s\nLicense type:        %s\nReferral count (GB): %s\n",
+		acc.License, acc.Type, acc.RefCount)
+	return err
+}
+
+func runApplyKey(ctx context.Context, e *env, args []string, _ io.Writer) error {
+	fs := newFlagSet("apply-key", "ID TOKEN LICENSE")
+	if err := parse(fs, args, 3); err != nil {
+		return err
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	if err := c.ApplyKey(ctx, &client.Account{ID: fs.Arg(0), Token: fs.Arg(1)}, fs.Arg(2)); err != nil {
+		return err
+	}
+	log.Info().Str("id", fs.Arg(0)).Msg("applied the key")
+
+	return nil
+}
+
+func runRemoveDevice(ctx context.Context, e *env, args []string, _ io.Writer) error {
+	fs := newFlagSet("remove-device", "ID TOKEN")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	if err := c.RemoveDevice(ctx, &client.Account{ID: fs.Arg(0), Token: fs.Arg(1)}); err != nil {
+		return err
+	}
+	log.Info().Str("id", fs.Arg(0)).Msg("removed the device")
+
+	return nil
+}
+
+func runConfig(ctx context.Context, e *env, args []string, out io.Writer) error {
+	fs := newFlagSet("config", "[-license KEY] [-out PATH]")
+	license := fs.String("license", "", "license to apply to the device, the device gets a free license if empty")
+	path := fs.String("out", "-", "file to write the WireGuard config to, - for stdout")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	c, err := e.client()
+	if err != nil {
+		return err
+	}
+	store, err := e.store()
+	if err != nil {
+		return err
+	}
+
+	dev, err := c.NewDevice(ctx, *license)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("id", dev.ID).Msg("registered a device")
+
+	data, err := c.GetAccountData(ctx, dev)
+	if err != nil {
+		// The device is usable anyway, "accounts refresh" can fill the data in later.
+		log.Warn().Err(err).Msg("failed to get the account data")
+	}
+	store.Add(newStoredAccount(dev, data))
+	if err := store.Save(); err != nil {
+		return err
+	}
+
+	return writeWireGuardConfig(dev.WireGuardConfig, *path, out)
+}
+
+// writeWireGuardConfig writes the WireGuard config returned by config to path, or to out if the path is "-".
+func writeWireGuardConfig(config func() (string, error), path string, out io.Writer) error {
+	conf, err := config()
+	if err != nil {
+		return err
+	}
+
+	if path == "-" {
+		_, err = io.WriteString(out, conf)
+		return err
+	}
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		return err
+	}
+	log.Info().Str("path", path).Msg("wrote the WireGuard config")
+
+	return nil
+}
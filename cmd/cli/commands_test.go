@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/client/clienttest"
+	"github.com/handsomefox/gowarp/cmd/http/server"
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/models/memory"
+)
+
+// newTestServer runs a gowarp server with an empty in-memory pool that talks to a fake upstream.
+func newTestServer(t *testing.T) (*httptest.Server, *clienttest.Server) {
+	t.Helper()
+
+	fake := clienttest.NewServer()
+	t.Cleanup(fake.Close)
+
+	db, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The JSON API renders no templates.
+	s, err := server.New(context.Background(), db, templates.Map{}, server.Config{
+		ClientOptions: []client.Option{client.WithConfiguration(fake.Configuration())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	return ts, fake
+}
+
+func TestGenerateFromServer(t *testing.T) {
+	cli := newTestCLI(t)
+	ts, fake := newTestServer(t)
+
+	code, out := cli.run(t, "-server", ts.URL, "generate", "-count", "2", "-output", "json")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	var keys []AccountOutput
+	if err := json.Unmarshal([]byte(out), &keys); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out, err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	accounts := cli.accounts(t)
+	if len(accounts) != 2 {
+		t.Fatalf("%d accounts are stored, want 2", len(accounts))
+	}
+	for i, acc := range accounts {
+		if acc.hasDevice() || acc.Server != ts.URL || acc.License != keys[i].License {
+			t.Errorf("stored account = %+v, want the key %s from %s without a device", acc, keys[i].License, ts.URL)
+		}
+	}
+	if n := fake.Devices(); n != 0 {
+		t.Errorf("%d devices are registered, want 0", n)
+	}
+}
+
+func TestGenerateWireGuardFromServer(t *testing.T) {
+	cli := newTestCLI(t)
+	ts, fake := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "wg.conf")
+
+	if code, _ := cli.run(t, "-server", ts.URL, "generate", "-wireguard", path); code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	conf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(conf), "PublicKey = "+clienttest.PeerPublicKey) {
+		t.Errorf("config doesn't contain the peer:\n%s", conf)
+	}
+
+	accounts := cli.accounts(t)
+	if len(accounts) != 1 || accounts[0].WireGuardConfig != string(conf) {
+		t.Fatalf("stored accounts = %+v, want the key with its config", accounts)
+	}
+	license := accounts[0].License
+
+	if code, _ := cli.run(t, "accounts", "refresh", license); code != exitFailure {
+		t.Errorf("refresh exit code = %d, want %d", code, exitFailure)
+	}
+	if code, _ := cli.run(t, "accounts", "delete", license); code != exitOK {
+		t.Fatalf("delete exit code = %d, want %d", code, exitOK)
+	}
+	if accounts := cli.accounts(t); len(accounts) != 0 {
+		t.Errorf("stored accounts = %+v, want the key forgotten", accounts)
+	}
+	if n := fake.Devices(); n != 1 {
+		t.Errorf("%d devices are registered, want the device of the server kept", n)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	cli := newTestCLI(t)
+	fake := newUpstream(t)
+
+	code, out := cli.run(t, "generate", "-count", "2", "-output", "json")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	var keys []AccountOutput
+	if err := json.Unmarshal([]byte(out), &keys); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out, err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	accounts := cli.accounts(t)
+	if len(accounts) != 2 {
+		t.Fatalf("%d accounts are stored, want 2", len(accounts))
+	}
+	for i, acc := range accounts {
+		if !acc.hasDevice() || acc.Token == "" || acc.PrivateKey == "" || acc.License != keys[i].License {
+			t.Errorf("stored account = %+v, want the device holding %s", acc, keys[i].License)
+		}
+	}
+	if n := fake.Devices(); n != 2 {
+		t.Errorf("%d devices are registered, want the 2 devices holding the keys", n)
+	}
+}
+
+func TestGenerateFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault bool
+		args  []string
+	}{
+		{name: "upstream failure", fault: true},
+		{name: "key too small", args: []string{"-min-refcount", "1000000000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := newTestCLI(t)
+			fake := newUpstream(t)
+			if tt.fault {
+				fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Status: http.StatusInternalServerError})
+			}
+
+			code, out := cli.run(t, append([]string{"generate", "-output", "json"}, tt.args...)...)
+			if code != exitFailure {
+				t.Errorf("exit code = %d, want %d", code, exitFailure)
+			}
+			if strings.TrimSpace(out) != "[]" {
+				t.Errorf("output = %q, want an empty array", out)
+			}
+			if accounts := cli.accounts(t); len(accounts) != 0 {
+				t.Errorf("stored accounts = %+v, want none", accounts)
+			}
+			if n := fake.Devices(); n != 0 {
+				t.Errorf("%d devices are registered, want them removed", n)
+			}
+		})
+	}
+}
+
+func TestGenerateWireGuard(t *testing.T) {
+	cli := newTestCLI(t)
+	newUpstream(t)
+
+	code, out := cli.run(t, "generate", "-wireguard", "-")
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d", code, exitOK)
+	}
+	if !strings.Contains(out, "PublicKey = "+clienttest.PeerPublicKey) {
+		t.Errorf("output doesn't contain the config of the device:\n%s", out)
+	}
+	accounts := cli.accounts(t)
+	if len(accounts) != 1 || !strings.Contains(out, "PrivateKey = "+accounts[0].PrivateKey) {
+		t.Errorf("stored accounts = %+v, want the device of the config", accounts)
+	}
+}
+
+func TestDeviceCommands(t *testing.T) {
+	cli := newTestCLI(t)
+	fake := newUpstream(t)
+
+	// A key to apply later.
+	code, out := cli.run(t, "generate", "-output", "json")
+	if code != exitOK {
+		t.Fatalf("generate exit code = %d, want %d", code, exitOK)
+	}
+	var keys []AccountOutput
+	if err := json.Unmarshal([]byte(out), &keys); err != nil || len(keys) != 1 {
+		t.Fatalf("generate output = %q, want a key", out)
+	}
+	key := keys[0]
+
+	path := filepath.Join(t.TempDir(), "wg.conf")
+	if code, _ := cli.run(t, "config", "-out", path); code != exitOK {
+		t.Fatalf("config exit code = %d, want %d", code, exitOK)
+	}
+	conf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(conf), "PublicKey = "+clienttest.PeerPublicKey) {
+		t.Errorf("config doesn't contain the peer:\n%s", conf)
+	}
+	accounts := cli.accounts(t)
+	if len(accounts) != 2 {
+		t.Fatalf("%d accounts are stored, want the key and the device of the config", len(accounts))
+	}
+	dev := accounts[1]
+
+	info := func() AccountOutput {
+		t.Helper()
+		code, out := cli.run(t, "info", "-output", "json", dev.ID, dev.Token)
+		if code != exitOK {
+			t.Fatalf("info exit code = %d, want %d", code, exitOK)
+		}
+		var acc AccountOutput
+		if err := json.Unmarshal([]byte(out), &acc); err != nil {
+			t.Fatalf("invalid JSON output %q: %v", out, err)
+		}
+		return acc
+	}
+	if acc := info(); acc.License != dev.License || acc.Type != "free" {
+		t.Errorf("info = %+v, want the free license %s of the device", acc, dev.License)
+	}
+
+	if code, _ := cli.run(t, "apply-key", dev.ID, dev.Token, key.License); code != exitOK {
+		t.Fatalf("apply-key exit code = %d, want %d", code, exitOK)
+	}
+	if acc := info(); acc != key {
+		t.Errorf("info after apply-key = %+v, want %+v", acc, key)
+	}
+
+	if code, _ := cli.run(t, "remove-device", dev.ID, dev.Token); code != exitOK {
+		t.Fatalf("remove-device exit code = %d, want %d", code, exitOK)
+	}
+	if n := fake.Devices(); n != 1 {
+		t.Errorf("%d devices are registered, want only the device of the key", n)
+	}
+	if code, _ := cli.run(t, "info", dev.ID, dev.Token); code != exitFailure {
+		t.Errorf("info of a removed device exit code = %d, want %d", code, exitFailure)
+	}
+}
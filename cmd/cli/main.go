@@ -2,41 +2,164 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/handsomefox/gowarp/client"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const usage = `Usage: gowarp-cli [-v] [-store PATH] [-server URL [-token TOKEN]] <command> [arguments]
+
+Commands:
+  generate [-count N] [-output text|json] [-min-refcount N] [-wireguard PATH]
+                                  generate keys, optionally with the WireGuard config of a device using it
+  info [-output text|json] ID TOKEN
+                                  show the account of a registered device
+  apply-key ID TOKEN LICENSE      apply the license to a registered device
+  remove-device ID TOKEN          remove a registered device
+  config [-license KEY] [-out PATH]
+                                  register a device and print its WireGuard config
+  accounts list [-output text|json]
+                                  list the devices registered by generate and config
+  accounts show [-output text|json] ID
+                                  show a registered device
+  accounts refresh [-output text|json] ID
+                                  update the account data of a registered device from the upstream
+  accounts delete [-local] ID     remove a registered device, -local only forgets it
+
+Every device registered by generate and config is recorded in the local store,
+gowarp/accounts.json under the user config directory unless -store is set.
+
+With -server, generate gets the keys from the gowarp server at URL instead of the
+upstream API, authenticated by -token or GOWARP_TOKEN, and -wireguard gets the config
+of a device registered by the server. These keys are recorded in the local store by
+their license: they can't be refreshed and deleting them only forgets them. The other
+commands always use the upstream API, which is configured by the YAML file at
+GOWARP_CONFIG or the GOWARP_* variables.
+
+Exit codes: 0 on success, 1 if the command failed, 2 on invalid usage.
+`
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+var (
+	errUsage = errors.New("invalid usage")
+	// errHelp is returned by a command if its help was requested, the usage is already printed.
+	errHelp = errors.New("help requested")
+)
+
+// command is a subcommand of the CLI, it writes its result to out and everything else to the log.
+type command func(ctx context.Context, e *env, args []string, out io.Writer) error
+
+// env is shared by the commands, the client is only configured when a command needs it.
+type env struct {
+	verbose   bool
+	storePath string
+	// server is the URL of the gowarp server to get the keys from, token authenticates to it.
+	server string
+	token  string
+	c      *client.Client
+}
+
+func (e *env) client() (*client.Client, error) {
+	if e.c == nil {
+		c, err := newClient(e.verbose)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure the client: %w", err)
+		}
+		e.c = c
+	}
+	return e.c, nil
+}
+
+func (e *env) store() (*Store, error) {
+	return LoadStore(e.storePath)
+}
+
+var commands = map[string]command{
+	"generate":      runGenerate,
+	"info":          runInfo,
+	"apply-key":     runApplyKey,
+	"remove-device": runRemoveDevice,
+	"config":        runConfig,
+	"accounts":      runAccounts,
+}
+
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	log.Logger = log.Logger.Level(zerolog.DebugLevel)
+	log.Logger = log.Logger.Level(zerolog.InfoLevel)
 
-	ctx := context.Background()
-
-	c := client.NewClient(true)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout)
+	stop()
+	os.Exit(code)
+}
 
-	acc, err := c.NewAccountWithLicense(ctx)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create an account")
+// run runs the command line and returns the exit code.
+func run(ctx context.Context, args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("gowarp-cli", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	verbose := fs.Bool("v", false, "log the calls to the upstream API")
+	storePath := fs.String("store", defaultStorePath(), "path of the local store of the registered devices")
+	server := fs.String("server", os.Getenv("GOWARP_SERVER"), "URL of a gowarp server to get the keys from instead of the upstream API")
+	token := fs.String("token", os.Getenv("GOWARP_TOKEN"), "API token of the gowarp server")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *verbose {
+		log.Logger = log.Logger.Level(zerolog.TraceLevel)
 	}
 
-	rc, err := acc.RefCount.Int64()
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse referall count")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		fs.Usage()
+		return exitUsage
 	}
 
-	if rc < 1000 {
-		log.Fatal().Int64("ref_count", rc).Msg("generated key is too small to use")
+	e := &env{verbose: *verbose, storePath: *storePath, server: *server, token: *token}
+	switch err := cmd(ctx, e, fs.Args()[1:], out); {
+	case errors.Is(err, errHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case err != nil:
+		log.Err(err).Msg(name + " failed")
+		return exitFailure
 	}
 
-	log.Info().Msg("Generated a new account successfully!")
-	log.Info().Str("License             ", acc.License).Send()
-	log.Info().Str("Referral count (GB) ", fmt.Sprint(rc)).Send()
-	log.Info().Str("License Type        ", acc.Type).Send()
+	return exitOK
+}
+
+// newClient returns a client configured by GOWARP_CONFIG or the GOWARP_* variables,
+// falling back to the deprecated unprefixed variables if neither is set.
+func newClient(logging bool) (*client.Client, error) {
+	cfg, err := client.LoadConfiguration(os.Getenv("GOWARP_CONFIG"))
+	if errors.Is(err, client.ErrConfigurationNotFound) {
+		cfg, err = *client.GetConfiguration(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Print("Press enter to exit...")
-	fmt.Scanln()
+	return client.NewClientWithConfig(cfg, client.WithLogging(logging))
 }
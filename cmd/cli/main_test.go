@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/handsomefox/gowarp/client/clienttest"
+	"gopkg.in/yaml.v3"
+)
+
+// testCLI runs the command lines with a local store in a temporary directory.
+type testCLI struct {
+	store string
+}
+
+func newTestCLI(t *testing.T) *testCLI {
+	t.Helper()
+
+	// Only the flags of a test pick the server.
+	t.Setenv("GOWARP_SERVER", "")
+	t.Setenv("GOWARP_TOKEN", "")
+
+	return &testCLI{store: filepath.Join(t.TempDir(), "accounts.json")}
+}
+
+// newUpstream starts a fake upstream and points GOWARP_CONFIG to it.
+func newUpstream(t *testing.T) *clienttest.Server {
+	t.Helper()
+
+	fake := clienttest.NewServer()
+	t.Cleanup(fake.Close)
+
+	b, err := yaml.Marshal(fake.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOWARP_CONFIG", path)
+
+	return fake
+}
+
+// run runs the command line and returns the exit code and the output.
+func (c *testCLI) run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+
+	var out bytes.Buffer
+	code := run(context.Background(), append([]string{"-store", c.store}, args...), &out)
+	return code, out.String()
+}
+
+// accounts returns the accounts in the local store.
+func (c *testCLI) accounts(t *testing.T) []StoredAccount {
+	t.Helper()
+
+	store, err := LoadStore(c.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Accounts
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "help", args: []string{"-h"}, code: exitOK},
+		{name: "command help", args: []string{"generate", "-h"}, code: exitOK},
+		{name: "accounts help", args: []string{"accounts", "-h"}, code: exitOK},
+		{name: "accounts command help", args: []string{"accounts", "list", "-h"}, code: exitOK},
+		{name: "no command", code: exitUsage},
+		{name: "unknown command", args: []string{"unknown"}, code: exitUsage},
+		{name: "unknown flag", args: []string{"-unknown", "generate"}, code: exitUsage},
+		{name: "unknown command flag", args: []string{"generate", "-unknown"}, code: exitUsage},
+		{name: "invalid count", args: []string{"generate", "-count", "0"}, code: exitUsage},
+		{name: "invalid output", args: []string{"info", "-output", "xml", "id", "token"}, code: exitUsage},
+		{name: "missing arguments", args: []string{"apply-key", "id", "token"}, code: exitUsage},
+		{name: "unknown accounts command", args: []string{"accounts", "unknown"}, code: exitUsage},
+		{name: "unknown account", args: []string{"accounts", "show", "unknown"}, code: exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := newTestCLI(t)
+			if code, _ := cli.run(t, tt.args...); code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+var errNoAccount = errors.New("no such account in the local store")
+
+// StoredAccount is a device registered by the CLI, kept to manage it later.
+//
+// The keys got from a gowarp server with -server are recorded as well, but their device
+// is registered by the server, so they have no ID and token and are looked up by the license.
+type StoredAccount struct {
+	ID          string              `json:"id"`
+	Token       string              `json:"token"`
+	PrivateKey  string              `json:"private_key,omitempty"`
+	License     string              `json:"license"`
+	Type        string              `json:"account_type"`
+	RefCount    json.Number         `json:"referral_count"`
+	Config      client.DeviceConfig `json:"config"`
+	CreatedAt   time.Time           `json:"created_at"`
+	RefreshedAt time.Time           `json:"refreshed_at"`
+	// Server is the URL of the gowarp server the key was got from.
+	Server string `json:"server,omitempty"`
+	// WireGuardConfig is the config of the device registered by the server, if it was requested.
+	WireGuardConfig string `json:"wireguard_config,omitempty"`
+}
+
+func newStoredAccount(dev *client.Account, data *models.Account) StoredAccount {
+	now := time.Now().UTC()
+	acc := StoredAccount{
+		ID:          dev.ID,
+		Token:       dev.Token,
+		PrivateKey:  dev.PrivateKey,
+		License:     dev.Account.License,
+		Config:      dev.Config,
+		CreatedAt:   now,
+		RefreshedAt: now,
+	}
+	if data != nil {
+		acc.update(data)
+	}
+	return acc
+}
+
+func newServerAccount(server string, data *models.Account, wireGuardConfig string) StoredAccount {
+	now := time.Now().UTC()
+	acc := StoredAccount{
+		Server:          server,
+		WireGuardConfig: wireGuardConfig,
+		CreatedAt:       now,
+	}
+	acc.update(data)
+	return acc
+}
+
+// hasDevice reports whether the device of the account was registered by the CLI, so it can be managed.
+func (a *StoredAccount) hasDevice() bool {
+	return a.ID != ""
+}
+
+// key identifies the account in the store: the device id, or the license if there is no device.
+func (a *StoredAccount) key() string {
+	if a.hasDevice() {
+		return a.ID
+	}
+	return a.License
+}
+
+// update copies the account data returned by the upstream.
+func (a *StoredAccount) update(data *models.Account) {
+	a.License = data.License
+	a.Type = data.Type
+	a.RefCount = data.RefCount
+	a.RefreshedAt = time.Now().UTC()
+}
+
+// device returns the client representation of the device, used to call the upstream.
+func (a *StoredAccount) device() *client.Account {
+	dev := &client.Account{ID: a.ID, Token: a.Token, PrivateKey: a.PrivateKey, Config: a.Config}
+	dev.Account.License = a.License
+	return dev
+}
+
+// Store is the local JSON file with the accounts registered by the CLI.
+// It is not safe for concurrent use by several processes.
+type Store struct {
+	path     string
+	Accounts []StoredAccount `json:"accounts"`
+}
+
+// defaultStorePath returns gowarp/accounts.json under the user config directory.
+func defaultStorePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gowarp", "accounts.json")
+}
+
+// LoadStore reads the store at path, a missing file is an empty store.
+func LoadStore(path string) (*Store, error) {
+	if path == "" {
+		return nil, errors.New("no path for the local store, set -store")
+	}
+
+	s := &Store{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the local store: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("decoding the local store %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Save writes the store atomically, it holds the tokens and private keys so only the user can read it.
+func (s *Store) Save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("creating the local store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".accounts-*.json")
+	if err != nil {
+		return fmt.Errorf("writing the local store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing the local store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing the local store: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Add records the account, replacing the one with the same id, or the same license if it has no device.
+func (s *Store) Add(acc StoredAccount) {
+	if i := s.index(acc.key()); i >= 0 {
+		s.Accounts[i] = acc
+		return
+	}
+	s.Accounts = append(s.Accounts, acc)
+}
+
+// Get returns the account with the given id, or license if it has no device, or errNoAccount.
+func (s *Store) Get(id string) (*StoredAccount, error) {
+	i := s.index(id)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", errNoAccount, id)
+	}
+	return &s.Accounts[i], nil
+}
+
+// Remove forgets the account with the given id, or license if it has no device, or returns errNoAccount.
+func (s *Store) Remove(id string) error {
+	i := s.index(id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", errNoAccount, id)
+	}
+	s.Accounts = append(s.Accounts[:i], s.Accounts[i+1:]...)
+	return nil
+}
+
+func (s *Store) index(id string) int {
+	for i := range s.Accounts {
+		if s.Accounts[i].key() == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -2,9 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/handsomefox/gowarp/client"
 	"github.com/handsomefox/gowarp/cmd/http/server"
+	"github.com/handsomefox/gowarp/cmd/http/server/ratelimiter"
 	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/handsomefox/gowarp/internal/models/memory"
+	"github.com/handsomefox/gowarp/internal/models/mongo"
+	"github.com/handsomefox/gowarp/internal/models/sqlite"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -12,10 +25,23 @@ import (
 )
 
 type AppConfiguration struct {
-	DatabaseURI    string `env:"DB_URI"`
-	Port           string `env:"PORT"`
-	DatabaseName   string `env:"DATABASE_NAME"`
-	CollectionName string `env:"COLLECTION_NAME"`
+	DatabaseURI     string        `env:"DB_URI"`
+	Port            string        `env:"PORT"`
+	DatabaseName    string        `env:"DATABASE_NAME"`
+	CollectionName  string        `env:"COLLECTION_NAME"`
+	LeaseTimeout    time.Duration `env:"LEASE_TIMEOUT"`
+	Retention       time.Duration `env:"DELIVERED_RETENTION"`
+	RequireAuth     bool          `env:"REQUIRE_AUTH"`
+	TrustedProxies  string        `env:"TRUSTED_PROXIES"`
+	RateLimitStore  string        `env:"RATE_LIMIT_STORE"`
+	MinPoolSize     int64         `env:"MIN_POOL_SIZE"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT,default=30s"`
+	PoolTarget      int64         `env:"POOL_TARGET"`
+	PoolLow         int64         `env:"POOL_LOW_WATERMARK"`
+	PoolHigh        int64         `env:"POOL_HIGH_WATERMARK"`
+	FillInterval    time.Duration `env:"FILL_INTERVAL"`
+	FillBackoff     time.Duration `env:"FILL_BACKOFF"`
+	ClientConfig    string        `env:"GOWARP_CONFIG"`
 }
 
 func main() {
@@ -25,7 +51,8 @@ func main() {
 		log.Err(err).Msg("failed to load .env file")
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	var c AppConfiguration
 	if err := envconfig.Process(ctx, &c); err != nil {
@@ -40,24 +67,132 @@ func main() {
 		c.Port = "8080"
 	}
 
+	// gowarp-serve token ... manages the API tokens instead of starting the server.
+	tokenCommand := len(os.Args) > 1 && os.Args[1] == "token"
+	if tokenCommand {
+		if err := checkTokenStore(c.DatabaseURI); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+
+	db, err := openStore(ctx, &c)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to the database")
+	}
+
+	if tokenCommand {
+		err := runTokenCommand(ctx, db, os.Args[2:], os.Stdout)
+		if cerr := db.Close(context.Background()); cerr != nil {
+			log.Err(cerr).Msg("failed to close the database")
+		}
+		if err != nil {
+			if !errors.Is(err, errUsage) {
+				log.Err(err).Send()
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	tmpls, err := templates.Load()
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load templates")
 	}
 
-	dbParams := server.DBParams{
-		DBConnString: c.DatabaseURI,
-		DBName:       c.DatabaseName,
-		DBCollName:   c.CollectionName,
+	upstream, err := client.LoadConfiguration(c.ClientConfig)
+	switch {
+	case errors.Is(err, client.ErrConfigurationNotFound):
+		log.Warn().Msg("no GOWARP_CONFIG or GOWARP_* variables found, using the deprecated unprefixed variables")
+		upstream = *client.GetConfiguration()
+		if err := upstream.Validate(); err != nil {
+			log.Fatal().Err(err).Msg("invalid upstream configuration")
+		}
+	case err != nil:
+		log.Fatal().Err(err).Msg("invalid upstream configuration")
+	}
+
+	switch c.RateLimitStore {
+	case "", "memory", "database":
+	default:
+		log.Fatal().Str("value", c.RateLimitStore).Msg("invalid RATE_LIMIT_STORE, expected memory or database")
+	}
+
+	trustedProxies, err := ratelimiter.ParseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid TRUSTED_PROXIES")
 	}
 
-	s, err := server.New(ctx, dbParams, tmpls)
+	s, err := server.New(ctx, db, tmpls, server.Config{
+		LeaseTimeout:    c.LeaseTimeout,
+		RequireAuth:     c.RequireAuth,
+		Tokens:          db,
+		Counters:        db,
+		TrustedProxies:  trustedProxies,
+		SharedRateLimit: c.RateLimitStore == "database",
+		MinPoolSize:     c.MinPoolSize,
+		Fill: server.FillPolicy{
+			Target:        c.PoolTarget,
+			LowWatermark:  c.PoolLow,
+			HighWatermark: c.PoolHigh,
+			Interval:      c.FillInterval,
+			Backoff:       c.FillBackoff,
+		},
+		DeliveredRetention: c.Retention,
+		ClientOptions:      []client.Option{client.WithConfiguration(upstream)},
+	})
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
 
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ListenAndServe(":" + c.Port)
+	}()
 	log.Info().Str("addr", "localhost").Str("port", c.Port).Msg("server started on http://localhost:" + c.Port)
-	if err := s.ListenAndServe(":" + c.Port); err != nil {
-		log.Fatal().Err(err).Send()
+
+	select {
+	case err := <-errc:
+		log.Err(err).Msg("server stopped")
+	case <-ctx.Done():
+		log.Info().Msg("received a signal, shutting down")
+	}
+	// A second signal kills the process right away.
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Err(err).Msg("failed to shut down gracefully")
+		return
+	}
+	log.Info().Msg("server stopped gracefully")
+}
+
+// openStore picks the storage backend based on the scheme of the DB_URI.
+//
+//	mongodb://..., mongodb+srv://...  -> MongoDB, uses DATABASE_NAME and COLLECTION_NAME
+//	sqlite:///path/gowarp.db          -> embedded SQLite database at /path/gowarp.db
+//	memory://                         -> in-memory store, lost on exit
+//	memory:///path/snapshot.json      -> in-memory store, loaded from and saved to /path/snapshot.json
+func openStore(ctx context.Context, c *AppConfiguration) (models.Store, error) {
+	u, err := url.Parse(c.DatabaseURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_URI: %w", err)
+	}
+
+	switch u.Scheme {
+	case "mongodb", "mongodb+srv":
+		return mongo.NewAccountModel(ctx, c.DatabaseURI, c.DatabaseName, c.CollectionName)
+	case "sqlite":
+		// sqlite:///abs/path.db has an empty host, sqlite://rel/path.db does not.
+		path := u.Host + u.Path
+		if path == "" {
+			return nil, fmt.Errorf("invalid DB_URI: missing sqlite database path")
+		}
+		return sqlite.NewAccountModel(ctx, path)
+	case "memory":
+		return memory.NewAccountModel(u.Host + u.Path)
+	default:
+		return nil, fmt.Errorf("invalid DB_URI: unsupported scheme %q", u.Scheme)
 	}
 }
@@ -1,16 +1,26 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/models"
 	"github.com/rs/zerolog/log"
 )
 
+// APIError is an error that is reported to the user, either as the error page
+// or as a JSON body, depending on the requested content type.
 type APIError struct {
-	Err    string
-	Status int
+	Err    string `json:"error"`
+	Status int    `json:"status"`
 }
 
 func (e *APIError) Error() string {
@@ -36,31 +46,88 @@ func (s *Server) HandleGenerateKey() http.HandlerFunc {
 		key, err := s.GetKey(ctx)
 		if err != nil {
 			log.Err(err).Msg("error getting the key")
-			return ErrGetKey
+			return ErrAPIGetKey
 		}
 
-		if err := s.tmpls[templates.KeyID].Execute(w, key); err != nil {
-			log.Err(err).Msg("failed to exec template")
-			return ErrExecTmpl
+		if wantsJSON(r) {
+			return s.deliverKey(ctx, w, key, http.StatusOK, renderJSON(NewKeyResponse(key)))
 		}
 
-		return nil
+		page := &KeyPage{KeyResponse: NewKeyResponse(key)}
+
+		return s.deliverKey(ctx, w, key, http.StatusOK, s.renderTemplate(templates.KeyID, page))
 	})
 }
 
+// deliverKey writes the response produced by render and confirms the key once it was written.
+// The response is rendered into a buffer first, so a failed render releases the key instead of losing it.
+func (s *Server) deliverKey(ctx context.Context, w http.ResponseWriter, key *models.Account, status int, render renderFunc) error {
+	var buf bytes.Buffer
+	contentType, err := render(&buf)
+	if err != nil {
+		s.ReleaseKey(ctx, key)
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		// The lease will expire and the key will return to the pool.
+		log.Err(err).Msg("failed to write the response")
+		return nil
+	}
+	s.ConfirmKey(ctx, key)
+	s.RecordTokenUse(ctx)
+
+	return nil
+}
+
+// renderFunc writes a response body to w and returns its content type.
+type renderFunc func(w io.Writer) (contentType string, err error)
+
+// renderJSON renders v as the JSON body, like WriteJSON.
+func renderJSON(v any) renderFunc {
+	return func(w io.Writer) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return "application/json; charset=utf-8", err
+	}
+}
+
+// renderTemplate renders the template with the given data as the HTML body.
+func (s *Server) renderTemplate(id templates.TemplateID, data any) renderFunc {
+	return func(w io.Writer) (string, error) {
+		if err := s.tmpls[id].Execute(w, data); err != nil {
+			log.Err(err).Msg("failed to exec template")
+			return "", ErrExecTmpl
+		}
+		return "text/html; charset=utf-8", nil
+	}
+}
+
 type HandlerFuncErr func(w http.ResponseWriter, r *http.Request) error
 
+// WrapHandlerFuncErr converts the error returned by f to an error response,
+// which is either the error page or a JSON body, depending on the Accept header.
 func (s *Server) WrapHandlerFuncErr(f HandlerFuncErr) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
+			write := s.WriteErr
+			if wantsJSON(r) {
+				write = s.WriteJSONErr
+			}
+
 			var ae *APIError
 			if errors.As(err, &ae) {
-				if err := s.WriteErr(w, ae); err != nil {
+				if err := write(w, ae); err != nil {
 					log.Err(err).Send()
 				}
 				return
 			}
-			if err := s.WriteErr(w, &APIError{
+			if err := write(w, &APIError{
 				Err:    err.Error(),
 				Status: http.StatusInternalServerError,
 			}); err != nil {
@@ -70,6 +137,21 @@ func (s *Server) WrapHandlerFuncErr(f HandlerFuncErr) http.HandlerFunc {
 	}
 }
 
+// WrapJSONHandlerFuncErr is like WrapHandlerFuncErr, but always reports the errors as JSON.
+func (s *Server) WrapJSONHandlerFuncErr(f HandlerFuncErr) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := f(w, r); err != nil {
+			var ae *APIError
+			if !errors.As(err, &ae) {
+				ae = &APIError{Err: err.Error(), Status: http.StatusInternalServerError}
+			}
+			if err := s.WriteJSONErr(w, ae); err != nil {
+				log.Err(err).Send()
+			}
+		}
+	}
+}
+
 func (s *Server) WriteErr(w http.ResponseWriter, e *APIError) error {
 	w.WriteHeader(e.Status)
 	if err := s.tmpls[templates.ErrorID].Execute(w, e); err != nil {
@@ -79,3 +161,52 @@ func (s *Server) WriteErr(w http.ResponseWriter, e *APIError) error {
 
 	return nil
 }
+
+func (s *Server) WriteJSONErr(w http.ResponseWriter, e *APIError) error {
+	return s.WriteJSON(w, e.Status, e)
+}
+
+// WriteJSON encodes v and writes it with the given status.
+// The body is encoded before anything is written, so an encoding error can still be reported.
+func (s *Server) WriteJSON(w http.ResponseWriter, status int, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(append(b, '\n'))
+
+	return err
+}
+
+// wantsJSON reports whether the client prefers application/json over text/html.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html", "text/*", "*/*":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+
+	return jsonQ > htmlQ
+}
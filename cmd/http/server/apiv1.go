@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// KeyResponse is the JSON representation of a handed out key.
+type KeyResponse struct {
+	License  string      `json:"license"`
+	Type     string      `json:"account_type"`
+	RefCount json.Number `json:"referral_count"`
+}
+
+func NewKeyResponse(acc *models.Account) *KeyResponse {
+	return &KeyResponse{
+		License:  acc.License,
+		Type:     acc.Type,
+		RefCount: acc.RefCount,
+	}
+}
+
+// PoolResponse describes the current state of the key pool.
+type PoolResponse struct {
+	Size int64 `json:"size"`
+}
+
+// APIv1 returns the router of the versioned JSON API, it is mounted at /api/v1.
+// Every route has to be documented in the OpenAPISpec, see CheckSpec.
+func (s *Server) APIv1() chi.Router {
+	r := chi.NewRouter()
+
+	r.NotFound(s.WrapJSONHandlerFuncErr(func(_ http.ResponseWriter, _ *http.Request) error {
+		return ErrNotFound
+	}))
+	r.MethodNotAllowed(s.WrapJSONHandlerFuncErr(func(_ http.ResponseWriter, _ *http.Request) error {
+		return ErrMethodNotAllowed
+	}))
+
+	r.Method(
+		http.MethodPost,
+		"/keys",
+		s.keyLimiter.Handler(
+			s.RequireTokenJSON(s.HandleAPICreateKey()),
+			s.WrapJSONHandlerFuncErr(s.rejectRateLimited),
+		),
+	)
+	r.Method(
+		http.MethodPost,
+		"/configs",
+		s.keyLimiter.Handler(
+			s.RequireTokenJSON(s.HandleAPICreateConfig()),
+			s.WrapJSONHandlerFuncErr(s.rejectRateLimited),
+		),
+	)
+	r.Get(
+		"/pool",
+		s.HandleAPIPool(),
+	)
+	r.Get(
+		"/openapi.json",
+		s.HandleAPISpec(),
+	)
+
+	return r
+}
+
+var (
+	ErrNotFound         = &APIError{Err: "not found", Status: http.StatusNotFound}
+	ErrMethodNotAllowed = &APIError{Err: "method not allowed", Status: http.StatusMethodNotAllowed}
+	ErrAPIGetKey        = &APIError{Err: "failed to get the key", Status: http.StatusServiceUnavailable}
+	ErrRateLimited      = &APIError{Err: "too many requests, try again later", Status: http.StatusTooManyRequests}
+)
+
+// rejectRateLimited is the response to the requests rejected by the rate limiter.
+func (s *Server) rejectRateLimited(_ http.ResponseWriter, _ *http.Request) error {
+	s.metrics.RateLimitRejections.Inc()
+	return ErrRateLimited
+}
+
+// HandleAPICreateKey hands out a key as KeyResponse.
+func (s *Server) HandleAPICreateKey() http.HandlerFunc {
+	return s.WrapJSONHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		key, err := s.GetKey(ctx)
+		if err != nil {
+			log.Err(err).Msg("error getting the key")
+			return ErrAPIGetKey
+		}
+
+		return s.deliverKey(ctx, w, key, http.StatusCreated, renderJSON(NewKeyResponse(key)))
+	})
+}
+
+// HandleAPICreateConfig hands out a key together with the WireGuard config of a new device
+// registered with it, as ConfigResponse.
+func (s *Server) HandleAPICreateConfig() http.HandlerFunc {
+	return s.WrapJSONHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		key, resp, err := s.newConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		return s.deliverKey(ctx, w, key, http.StatusCreated, renderJSON(resp))
+	})
+}
+
+// HandleAPIPool reports the amount of keys available in the pool.
+func (s *Server) HandleAPIPool() http.HandlerFunc {
+	return s.WrapJSONHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		return s.WriteJSON(w, http.StatusOK, &PoolResponse{Size: s.db.Len(r.Context())})
+	})
+}
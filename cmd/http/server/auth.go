@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/auth"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrUnauthorized  = &APIError{Err: "missing or invalid API token", Status: http.StatusUnauthorized}
+	ErrQuotaExceeded = &APIError{Err: "daily key quota exceeded", Status: http.StatusTooManyRequests}
+)
+
+type tokenCtxKey struct{}
+
+// tokenUse is a key reserved for the token that authenticated the request.
+type tokenUse struct {
+	token      *models.Token
+	reservedAt time.Time
+	used       int64
+	handedOut  bool
+}
+
+// TokenFromContext returns the token that authenticated the request, or nil if there is none.
+func TokenFromContext(ctx context.Context) *models.Token {
+	if u := tokenUseFromContext(ctx); u != nil {
+		return u.token
+	}
+	return nil
+}
+
+func tokenUseFromContext(ctx context.Context) *tokenUse {
+	u, _ := ctx.Value(tokenCtxKey{}).(*tokenUse)
+	return u
+}
+
+// RequireToken only lets the requests with a valid bearer token that is within its daily quota through.
+// A key is reserved from the quota before the handler runs, the handler has to call RecordTokenUse once
+// the key was handed out, otherwise the reservation is given back. The errors are reported as the error
+// page or JSON, depending on the Accept header. It does nothing unless the server requires authentication.
+func (s *Server) RequireToken(next http.Handler) http.Handler {
+	return s.requireToken(next, s.WrapHandlerFuncErr)
+}
+
+// RequireTokenJSON is like RequireToken, but always reports the errors as JSON.
+func (s *Server) RequireTokenJSON(next http.Handler) http.Handler {
+	return s.requireToken(next, s.WrapJSONHandlerFuncErr)
+}
+
+func (s *Server) requireToken(next http.Handler, wrap func(HandlerFuncErr) http.HandlerFunc) http.Handler {
+	if !s.cfg.RequireAuth {
+		return next
+	}
+
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		secret, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gowarp"`)
+			return ErrUnauthorized
+		}
+
+		t, err := auth.Authenticate(ctx, s.cfg.Tokens, secret)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gowarp", error="invalid_token"`)
+			return ErrUnauthorized
+		}
+
+		u := &tokenUse{token: t, reservedAt: time.Now()}
+		u.used, err = auth.Reserve(ctx, s.cfg.Counters, t, u.reservedAt)
+		if err != nil {
+			if errors.Is(err, auth.ErrQuotaExceeded) {
+				log.Info().Str("token_id", t.ID).Msg("token is over its daily quota")
+				return ErrQuotaExceeded
+			}
+			log.Err(err).Str("token_id", t.ID).Msg("failed to reserve the token quota")
+			return err
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenCtxKey{}, u)))
+
+		if !u.handedOut {
+			if err := auth.Release(context.WithoutCancel(ctx), s.cfg.Counters, t, u.reservedAt); err != nil {
+				log.Err(err).Str("token_id", t.ID).Msg("failed to release the token quota")
+			}
+		}
+		return nil
+	})
+}
+
+// bearerToken extracts the token from the "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+
+	return token, token != ""
+}
+
+// RecordTokenUse keeps the key reserved for the token that authenticated the request, if any,
+// because it was handed out.
+func (s *Server) RecordTokenUse(ctx context.Context) {
+	u := tokenUseFromContext(ctx)
+	if u == nil {
+		return
+	}
+	u.handedOut = true
+
+	log.Info().Str("token_id", u.token.ID).Int64("used", u.used).Int64("quota", u.token.DailyQuota).Send()
+}
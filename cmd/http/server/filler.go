@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidFillPolicy = errors.New("server: invalid fill policy")
+
+// FillPolicy controls how the background filler keeps the pool of keys stocked.
+//
+// Once the pool drops below LowWatermark, a key is generated every Interval until the
+// pool reaches Target. While the pool is at or above HighWatermark, e.g. because several
+// replicas fill the same database, the filler backs off for Backoff between the checks.
+type FillPolicy struct {
+	Target        int64
+	LowWatermark  int64
+	HighWatermark int64
+	Interval      time.Duration
+	Backoff       time.Duration
+}
+
+// DefaultFillPolicy is used for the zero fields of the configured FillPolicy.
+var DefaultFillPolicy = FillPolicy{
+	Target:        200,
+	LowWatermark:  150,
+	HighWatermark: 800,
+	Interval:      30 * time.Second,
+	Backoff:       20 * time.Minute,
+}
+
+func (p FillPolicy) withDefaults() FillPolicy {
+	if p.Target == 0 {
+		p.Target = DefaultFillPolicy.Target
+	}
+	if p.LowWatermark == 0 {
+		p.LowWatermark = min(DefaultFillPolicy.LowWatermark, p.Target)
+	}
+	if p.HighWatermark == 0 {
+		p.HighWatermark = max(DefaultFillPolicy.HighWatermark, p.Target)
+	}
+	if p.Interval == 0 {
+		p.Interval = DefaultFillPolicy.Interval
+	}
+	if p.Backoff == 0 {
+		p.Backoff = DefaultFillPolicy.Backoff
+	}
+	return p
+}
+
+// Validate checks that 0 < LowWatermark <= Target <= HighWatermark and that the durations are positive.
+func (p FillPolicy) Validate() error {
+	switch {
+	case p.LowWatermark <= 0:
+		return fmt.Errorf("%w: low watermark must be positive, got %d", ErrInvalidFillPolicy, p.LowWatermark)
+	case p.LowWatermark > p.Target:
+		return fmt.Errorf("%w: low watermark (%d) is above the target (%d)", ErrInvalidFillPolicy, p.LowWatermark, p.Target)
+	case p.Target > p.HighWatermark:
+		return fmt.Errorf("%w: target (%d) is above the high watermark (%d)", ErrInvalidFillPolicy, p.Target, p.HighWatermark)
+	case p.Interval <= 0:
+		return fmt.Errorf("%w: interval must be positive, got %s", ErrInvalidFillPolicy, p.Interval)
+	case p.Backoff <= 0:
+		return fmt.Errorf("%w: backoff must be positive, got %s", ErrInvalidFillPolicy, p.Backoff)
+	}
+	return nil
+}
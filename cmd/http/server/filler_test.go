@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/client/clienttest"
+)
+
+// settle gives the filler a few intervals to act.
+const settle = 100 * time.Millisecond
+
+func TestFillHysteresis(t *testing.T) {
+	ctx := context.Background()
+	_, fake, db := newTestServer(t, Config{Fill: FillPolicy{
+		Target:        3,
+		LowWatermark:  2,
+		HighWatermark: 10,
+		Interval:      5 * time.Millisecond,
+		Backoff:       time.Hour,
+	}})
+
+	waitFor(t, "the pool to reach the target", func() bool { return db.Len(ctx) == 3 })
+	registrations := fake.Requests(clienttest.EndpointRegister)
+	time.Sleep(settle)
+	if n := db.Len(ctx); n != 3 {
+		t.Fatalf("pool size = %d, want the filler to stop at the target", n)
+	}
+	if n := fake.Requests(clienttest.EndpointRegister); n != registrations {
+		t.Errorf("the upstream was called %d more times at the target", n-registrations)
+	}
+
+	// Down to the low watermark, which is not below it.
+	if _, err := db.Lease(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(settle)
+	if n := db.Len(ctx); n != 2 {
+		t.Fatalf("pool size = %d, want no refill at the low watermark", n)
+	}
+
+	if _, err := db.Lease(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the pool to be refilled to the target", func() bool { return db.Len(ctx) == 3 })
+}
+
+func TestFillBacksOffAtHighWatermark(t *testing.T) {
+	ctx := context.Background()
+	_, fake, db := newTestServer(t, Config{Fill: FillPolicy{
+		Target:        2,
+		LowWatermark:  2,
+		HighWatermark: 2,
+		Interval:      5 * time.Millisecond,
+		Backoff:       time.Hour,
+	}})
+
+	waitFor(t, "the pool to reach the high watermark", func() bool { return db.Len(ctx) == 2 })
+	time.Sleep(settle)
+
+	// The filler is backing off, so the emptied pool is not refilled.
+	registrations := fake.Requests(clienttest.EndpointRegister)
+	for i := 0; i < 2; i++ {
+		if _, err := db.Lease(ctx, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(settle)
+	if n := db.Len(ctx); n != 0 {
+		t.Errorf("pool size = %d, want no refill during the backoff", n)
+	}
+	if n := fake.Requests(clienttest.EndpointRegister); n != registrations {
+		t.Errorf("the upstream was called %d times during the backoff", n-registrations)
+	}
+}
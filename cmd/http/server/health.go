@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/breaker"
+)
+
+// The statuses reported by the health checks.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// HealthResponse is the body of /healthz and /readyz.
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the outcome of a single readiness check.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Details holds check specific values, e.g. the pool size.
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// HandleLiveness reports that the process is up, it doesn't check the dependencies,
+// so a replica with a broken database is not restarted in a loop.
+func (s *Server) HandleLiveness() http.HandlerFunc {
+	return s.WrapJSONHandlerFuncErr(func(w http.ResponseWriter, _ *http.Request) error {
+		return s.WriteJSON(w, http.StatusOK, &HealthResponse{Status: StatusOK})
+	})
+}
+
+// HandleReadiness reports whether the server can actually hand out keys.
+// It responds with http.StatusServiceUnavailable if any of the checks fails.
+func (s *Server) HandleReadiness() http.HandlerFunc {
+	return s.WrapJSONHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		res := s.Readiness(ctx)
+		status := http.StatusOK
+		if res.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		return s.WriteJSON(w, status, res)
+	})
+}
+
+// Readiness runs the readiness checks.
+func (s *Server) Readiness(ctx context.Context) *HealthResponse {
+	res := &HealthResponse{
+		Status: StatusOK,
+		Checks: make(map[string]HealthCheck),
+	}
+	add := func(name string, check HealthCheck) {
+		if check.Status != StatusOK {
+			res.Status = StatusFail
+		}
+		res.Checks[name] = check
+	}
+
+	dbCheck := HealthCheck{Status: StatusOK}
+	if err := s.db.Ping(ctx); err != nil {
+		dbCheck = HealthCheck{Status: StatusFail, Error: err.Error()}
+	}
+	add("database", dbCheck)
+
+	poolCheck := HealthCheck{Status: StatusOK}
+	if dbCheck.Status == StatusOK {
+		size := s.db.Len(ctx)
+		poolCheck.Details = map[string]any{"size": size, "min": s.cfg.MinPoolSize}
+		if size < s.cfg.MinPoolSize {
+			poolCheck.Status = StatusFail
+			poolCheck.Error = "the pool is below the minimum size"
+		}
+	} else {
+		poolCheck = HealthCheck{Status: StatusFail, Error: "the database is unavailable"}
+	}
+	add("pool", poolCheck)
+
+	tmplCheck := HealthCheck{Status: StatusOK}
+	if err := s.tmpls.Check(); err != nil {
+		tmplCheck = HealthCheck{Status: StatusFail, Error: err.Error()}
+	}
+	add("templates", tmplCheck)
+
+	cfg := s.client.Configuration()
+	cfgCheck := HealthCheck{Status: StatusOK}
+	if err := cfg.Validate(); err != nil {
+		cfgCheck = HealthCheck{Status: StatusFail, Error: err.Error()}
+	}
+	add("client_configuration", cfgCheck)
+
+	// An open circuit is only a problem when there is nothing in the pool to hand out.
+	st := s.upstream.Status()
+	upstreamCheck := HealthCheck{
+		Status:  StatusOK,
+		Details: map[string]any{"state": st.State.String(), "failures": st.Failures},
+	}
+	if st.State == breaker.Open {
+		upstreamCheck.Details["retry_at"] = st.RetryAt
+		if size, ok := poolCheck.Details["size"].(int64); !ok || size == 0 {
+			upstreamCheck.Status = StatusFail
+			upstreamCheck.Error = "the upstream is unavailable and the pool is empty"
+		}
+	}
+	add("upstream", upstreamCheck)
+
+	return res
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/handsomefox/gowarp/client/clienttest"
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+func TestReadinessEmptyPool(t *testing.T) {
+	ctx := context.Background()
+	s, _, db := newTestServer(t, Config{MinPoolSize: 1})
+
+	w := do(s, http.MethodGet, "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	res := decode[HealthResponse](t, w)
+	if res.Status != StatusFail || res.Checks["pool"].Status != StatusFail {
+		t.Errorf("readiness = %+v, want the pool check failed", res)
+	}
+
+	if _, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: "pooled"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(s, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("status with a key in the pool = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestReadinessOpenBreaker(t *testing.T) {
+	ctx := context.Background()
+	s, fake, db := newTestServer(t, Config{})
+
+	fake.Inject(clienttest.AnyEndpoint, clienttest.Fault{Status: http.StatusInternalServerError})
+	for i := 0; i < 5; i++ {
+		if _, err := s.GetKey(ctx); err == nil {
+			t.Fatal("GetKey() succeeded with a failing upstream")
+		}
+	}
+
+	w := do(s, http.MethodGet, "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	res := decode[HealthResponse](t, w)
+	upstream := res.Checks["upstream"]
+	if upstream.Status != StatusFail || upstream.Details["state"] != "open" {
+		t.Errorf("upstream check = %+v, want failed with the open breaker", upstream)
+	}
+
+	// An open breaker is fine as long as there are keys to hand out.
+	if _, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: "pooled"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(s, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("status with a key in the pool = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
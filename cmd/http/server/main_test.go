@@ -0,0 +1,28 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata is the absolute path of the testdata directory, the tests run from the repository root.
+var testdata string
+
+func TestMain(m *testing.M) {
+	dir, err := filepath.Abs("testdata")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testdata = dir
+
+	// The templates and the static files are loaded relative to the repository root.
+	if err := os.Chdir("../../.."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,142 @@
+// Package metrics defines the Prometheus metrics exported by the server.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gowarp"
+
+// The sources of the handed out keys.
+const (
+	SourcePool      = "pool"
+	SourceGenerated = "generated"
+)
+
+// ErrKeyTooSmall is reported when a generated key is too small to be stored.
+var ErrKeyTooSmall = errors.New("metrics: generated key was too small")
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	GenerationAttempts  prometheus.Counter
+	GenerationSuccesses prometheus.Counter
+	GenerationFailures  *prometheus.CounterVec
+	ClientCallDuration  *prometheus.HistogramVec
+	Handouts            *prometheus.CounterVec
+	RateLimitRejections prometheus.Counter
+}
+
+// New registers the metrics, poolSize is called on every scrape to report the size of the key pool.
+func New(poolSize func() float64) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		GenerationAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "generation_attempts_total",
+			Help:      "Number of attempts to generate a key.",
+		}),
+		GenerationSuccesses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "generation_successes_total",
+			Help:      "Number of keys generated successfully.",
+		}),
+		GenerationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "generation_failures_total",
+			Help:      "Number of failed attempts to generate a key, by error.",
+		}, []string{"error"}),
+		ClientCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "client_call_duration_seconds",
+			Help:      "Duration of the calls to the upstream API, by client method.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10), // 50ms to ~25s
+		}, []string{"op"}),
+		Handouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handouts_total",
+			Help:      "Number of keys handed out, by source (pool or generated on the fly).",
+		}, []string{"source"}),
+		RateLimitRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_rejections_total",
+			Help:      "Number of requests rejected by the rate limiter.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_size",
+			Help:      "Number of keys in the pool that can be handed out.",
+		}, poolSize),
+		m.GenerationAttempts,
+		m.GenerationSuccesses,
+		m.GenerationFailures,
+		m.ClientCallDuration,
+		m.Handouts,
+		m.RateLimitRejections,
+	)
+
+	// Initialize the known labels, so the series exist before the first event.
+	for _, label := range []string{SourcePool, SourceGenerated} {
+		m.Handouts.WithLabelValues(label)
+	}
+	for _, label := range errorLabels {
+		m.GenerationFailures.WithLabelValues(label.name)
+	}
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveClientCall records the duration of a client.Client call, see client.WithTimingObserver.
+func (m *Metrics) ObserveClientCall(op string, d time.Duration) {
+	m.ClientCallDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// ObserveGeneration records the outcome of an attempt to generate a key, err is nil on success.
+func (m *Metrics) ObserveGeneration(err error) {
+	m.GenerationAttempts.Inc()
+	if err == nil {
+		m.GenerationSuccesses.Inc()
+		return
+	}
+	m.GenerationFailures.WithLabelValues(ErrorLabel(err)).Inc()
+}
+
+var errorLabels = []struct {
+	err  error
+	name string
+}{
+	{client.ErrRegAccount, "ErrRegAccount"},
+	{client.ErrUpdateAccount, "ErrUpdateAccount"},
+	{client.ErrEncodeAccount, "ErrEncodeAccount"},
+	{client.ErrDecodeAccount, "ErrDecodeAccount"},
+	{client.ErrGetAccountData, "ErrGetAccountData"},
+	{client.ErrFetchingConfiguration, "ErrFetchingConfiguration"},
+	{ErrKeyTooSmall, "ErrKeyTooSmall"},
+}
+
+// ErrorLabel returns the name of the known error err matches, or "other".
+func ErrorLabel(err error) string {
+	for _, label := range errorLabels {
+		if errors.Is(err, label.err) {
+			return label.name
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// OpenAPISpec is the OpenAPI 3 document describing the routes of APIv1.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+// HandleAPISpec serves the OpenAPISpec.
+func (s *Server) HandleAPISpec() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if _, err := w.Write(OpenAPISpec); err != nil {
+			return
+		}
+	}
+}
+
+// CheckSpec compares the routes of the router with the operations in the OpenAPISpec
+// and returns an error listing every route or operation that is missing on the other side.
+// It is run by the tests, so the spec can not drift from the routes.
+func CheckSpec(routes chi.Routes) error {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(OpenAPISpec, &spec); err != nil {
+		return fmt.Errorf("server: invalid openapi spec: %w", err)
+	}
+
+	documented := make(map[string]bool)
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	routed := make(map[string]bool)
+	err := chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("server: failed to walk the routes: %w", err)
+	}
+
+	var problems []string
+	for op := range routed {
+		if !documented[op] {
+			problems = append(problems, "undocumented route "+op)
+		}
+	}
+	for op := range documented {
+		if !routed[op] {
+			problems = append(problems, "documented route "+op+" is not routed")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("server: openapi spec is out of sync: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	s := &Server{}
+	if err := CheckSpec(s.APIv1()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSpecReportsUndocumentedRoutes(t *testing.T) {
+	s := &Server{}
+	r := s.APIv1()
+	r.Get("/undocumented", func(http.ResponseWriter, *http.Request) {})
+
+	err := CheckSpec(r)
+	if err == nil || !strings.Contains(err.Error(), "undocumented route GET /undocumented") {
+		t.Fatalf("CheckSpec() = %v, want the undocumented route reported", err)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+)
+
+// ConfigFilename is the name of the downloaded WireGuard config, it becomes the name of the tunnel.
+const ConfigFilename = "gowarp.conf"
+
+// KeyPage is the data of the key page. QRCode is only set when the page shows a WireGuard config.
+type KeyPage struct {
+	*KeyResponse
+	QRCode *QRCode
+}
+
+// QRCode is a WireGuard config as a QR code to scan with the WireGuard app,
+// together with a download link for the config file.
+type QRCode struct {
+	Config string
+	// Image is the PNG of the QR code as a data URI.
+	Image template.URL
+	// Download is the config file as a data URI, it is saved as Filename.
+	Download template.URL
+	Filename string
+}
+
+// NewQRCode renders the QR code of the config. The QR code and the file are embedded
+// into the page, because the device is only registered once, when the page is requested.
+func NewQRCode(config string) (*QRCode, error) {
+	png, err := qrcode.Encode(config, qrcode.Medium, 512)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QRCode{
+		Config:   config,
+		Image:    template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		Download: template.URL("data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString([]byte(config))),
+		Filename: ConfigFilename,
+	}, nil
+}
+
+// HandleWireGuardQRCode hands out a key like HandleWireGuardConfig, but shows the config
+// on the key page as a QR code with a download link for the config file.
+func (s *Server) HandleWireGuardQRCode() http.HandlerFunc {
+	return s.WrapHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		key, resp, err := s.newConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		if wantsJSON(r) {
+			return s.deliverKey(ctx, w, key, http.StatusOK, renderJSON(resp))
+		}
+
+		qr, err := NewQRCode(resp.Config)
+		if err != nil {
+			log.Err(err).Msg("failed to render the QR code")
+			s.ReleaseKey(ctx, key)
+			return ErrExecTmpl
+		}
+		page := &KeyPage{KeyResponse: &resp.KeyResponse, QRCode: qr}
+
+		return s.deliverKey(ctx, w, key, http.StatusOK, s.renderTemplate(templates.KeyID, page))
+	})
+}
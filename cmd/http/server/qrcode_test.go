@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the golden file, or rewrites the file with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join(testdata, name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s doesn't match the golden file, run the tests with -update if the change is intended", name)
+	}
+}
+
+// testDevice is a device with fixed keys, so the rendered config never changes.
+func testDevice() *client.Account {
+	dev := &client.Account{
+		ID:         "t.00000000-0000-0000-0000-000000000000",
+		Key:        "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+	}
+	dev.Account.License = "xxxxxxxx-xxxxxxxx-xxxxxxxx"
+	dev.Config.Interface.Addresses.V4 = "172.16.0.2"
+	dev.Config.Interface.Addresses.V6 = "2606:4700:110:8f81::2"
+	dev.Config.Peers = []client.Peer{{PublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="}}
+	dev.Config.Peers[0].Endpoint.Host = "engage.example.com:2408"
+
+	return dev
+}
+
+func TestQRCodeGolden(t *testing.T) {
+	conf, err := testDevice().WireGuardConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qr, err := NewQRCode(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qr.Config != conf {
+		t.Errorf("QR code payload = %q, want the config %q", qr.Config, conf)
+	}
+	golden(t, "qrcode.conf", []byte(qr.Config))
+
+	tmpls, err := templates.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := &KeyPage{
+		KeyResponse: &KeyResponse{License: "xxxxxxxx-xxxxxxxx-xxxxxxxx", Type: "limited", RefCount: "1000"},
+		QRCode:      qr,
+	}
+	var buf bytes.Buffer
+	if err := tmpls[templates.KeyID].Execute(&buf, page); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "key_qrcode.html", buf.Bytes())
+}
@@ -0,0 +1,137 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithTrustedProxies makes the limiter trust the X-Forwarded-For and X-Real-Ip headers,
+// but only if they were set by one of the proxies in the given networks.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(l *Limiter) {
+		l.trustedProxies = prefixes
+	}
+}
+
+// WithIPv6PrefixLen sets the prefix length IPv6 clients are aggregated by, it defaults to 64,
+// as a single client usually gets a whole /64 and can pick any address from it.
+func WithIPv6PrefixLen(bits int) Option {
+	return func(l *Limiter) {
+		l.ipv6PrefixLen = bits
+	}
+}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or single IPs, e.g. "10.0.0.0/8,::1".
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if strings.Contains(part, "/") {
+			p, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, fmt.Errorf("ratelimiter: invalid trusted proxy %q: %w", part, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("ratelimiter: invalid trusted proxy %q: %w", part, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// clientKey returns the key the request is limited by: the client IP,
+// or its network for IPv6 clients.
+func (l *Limiter) clientKey(r *http.Request) string {
+	addr, ok := l.clientIP(r)
+	if !ok {
+		// Should not happen with net/http, limit the unparsable addresses together.
+		return r.RemoteAddr
+	}
+
+	if addr.Is6() && l.ipv6PrefixLen > 0 && l.ipv6PrefixLen < 128 {
+		p, err := addr.Prefix(l.ipv6PrefixLen)
+		if err == nil {
+			return p.String()
+		}
+	}
+
+	return addr.String()
+}
+
+// clientIP resolves the IP of the client. The forwarding headers are only used if the
+// request came from a trusted proxy, and X-Forwarded-For is read right-to-left, skipping
+// the trusted proxies, because everything to the left of them could be set by the client.
+func (l *Limiter) clientIP(r *http.Request) (netip.Addr, bool) {
+	remote, ok := parseAddr(r.RemoteAddr)
+	if !ok || !l.trusted(remote) {
+		return remote, ok
+	}
+
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseAddr(strings.TrimSpace(hops[i]))
+			if !ok {
+				// Garbage in the header, the last valid hop is the best we know.
+				break
+			}
+			client = hop
+			if !l.trusted(hop) {
+				break
+			}
+		}
+		return client, true
+	}
+
+	if realIP, ok := parseAddr(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); ok {
+		return realIP, true
+	}
+
+	return remote, true
+}
+
+func (l *Limiter) trusted(addr netip.Addr) bool {
+	for _, p := range l.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses an IP with an optional port, e.g. "1.2.3.4", "1.2.3.4:5678", "[::1]:5678" or "::1".
+func parseAddr(s string) (netip.Addr, bool) {
+	if s == "" {
+		return netip.Addr{}, false
+	}
+
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap().WithZone(""), true
+}
@@ -0,0 +1,145 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{
+			name: "networks and addresses",
+			in:   " 10.1.2.3/8, ::1 ,192.0.2.1,",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("::1/128"),
+				netip.MustParsePrefix("192.0.2.1/32"),
+			},
+		},
+		{
+			name: "IPv4-mapped address",
+			in:   "::ffff:192.0.2.1",
+			want: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")},
+		},
+		{name: "invalid CIDR", in: "10.0.0.0/33", wantErr: true},
+		{name: "invalid network", in: "10.0.0/8", wantErr: true},
+		{name: "invalid address", in: "10.0.0.1,proxy.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTrustedProxies(%q) error = %v, wantErr %t", tt.in, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTrustedProxies(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8,2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(nil, WithTrustedProxies(trusted))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xRealIP    string
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "forwarding headers from an untrusted peer",
+			remoteAddr: "192.0.2.1:1234",
+			xff:        []string{"198.51.100.1"},
+			xRealIP:    "198.51.100.2",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "trusted hops are skipped right to left",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.9, 198.51.100.1, 10.0.0.3", "10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "garbage stops at the last valid hop",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"198.51.100.1, unknown, 10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "ports are stripped",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"198.51.100.1:5678, [2001:db8::1]:5678"},
+			want:       "2001:db8::/64",
+		},
+		{
+			name:       "X-Real-Ip from a trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			xRealIP:    "198.51.100.1:5678",
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "IPv4-mapped peer",
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			xff:        []string{"::ffff:198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "IPv6 clients are aggregated by /64",
+			remoteAddr: "[2001:db8:1:2:aaaa::1]:1234",
+			want:       "2001:db8:1:2::/64",
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[2001:db8:ffff::1]:1234",
+			xff:        []string{"2001:db8:1:2:bbbb::1"},
+			want:       "2001:db8:1:2::/64",
+		},
+		{
+			name:       "zone is dropped",
+			remoteAddr: "[fe80::1%eth0]:1234",
+			want:       "fe80::/64",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xRealIP != "" {
+				r.Header.Set("X-Real-Ip", tt.xRealIP)
+			}
+
+			if got := l.clientKey(r); got != tt.want {
+				t.Errorf("clientKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
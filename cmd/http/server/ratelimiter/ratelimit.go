@@ -1,71 +1,111 @@
+// Package ratelimiter implements rate limiting of HTTP requests keyed by the client IP.
+//
+// The counting is done by a Backend: TokenBucket keeps the state in the process,
+// StoreBackend keeps it in a shared database, so the limit holds across several replicas.
 package ratelimiter
 
 import (
+	"context"
+	"math"
 	"net/http"
-	"sync"
+	"net/netip"
+	"strconv"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
-func New(h http.Handler, requestLimit int, requestPeriod time.Duration) http.HandlerFunc {
-	rl := &rateLimiter{
-		requestCounter: &ipRequestCount{ips: make(map[string]int, 0), mu: sync.Mutex{}},
-		requestPeriod:  requestPeriod,
-		requestLimit:   requestLimit,
-	}
-	go rl.clear()
+// Backend counts the requests made with every key.
+type Backend interface {
+	// Take records a request made with the key and reports whether it is within the limit.
+	Take(ctx context.Context, key string) (Result, error)
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ipAddr := readUserIP(r)
-		rl.requestCounter.increment(ipAddr)
-		cv := rl.requestCounter.get(ipAddr)
+// Result is the outcome of Backend.Take.
+type Result struct {
+	Allowed bool
+	// Limit is the amount of requests allowed per Window.
+	Limit  int
+	Window time.Duration
+	// Remaining is the amount of requests that can be made right now.
+	Remaining int
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, 0 if Allowed.
+	RetryAfter time.Duration
+}
 
-		if cv >= rl.requestLimit {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
+// Clock tells the current time, it can be replaced to control the time in tests.
+type Clock interface {
+	Now() time.Time
 }
 
-type rateLimiter struct {
-	requestCounter *ipRequestCount
-	requestPeriod  time.Duration
-	requestLimit   int
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Option configures the Limiter.
+type Option func(*Limiter)
+
+// Limiter limits the HTTP requests by the client IP using a Backend.
+type Limiter struct {
+	backend        Backend
+	trustedProxies []netip.Prefix
+	ipv6PrefixLen  int
 }
 
-func (rl *rateLimiter) clear() {
-	for {
-		rl.requestCounter.mu.Lock()
-		rl.requestCounter.ips = make(map[string]int)
-		rl.requestCounter.mu.Unlock()
-		time.Sleep(rl.requestPeriod)
+// NewLimiter returns a Limiter that counts the requests using the backend.
+func NewLimiter(backend Backend, opts ...Option) *Limiter {
+	l := &Limiter{
+		backend:       backend,
+		ipv6PrefixLen: 64,
+	}
+	for _, opt := range opts {
+		opt(l)
 	}
-}
 
-type ipRequestCount struct {
-	mu  sync.Mutex
-	ips map[string]int
+	return l
 }
 
-func (sc *ipRequestCount) increment(key string) {
-	sc.mu.Lock()
-	sc.ips[key]++
-	sc.mu.Unlock()
+// Middleware only lets the requests within the limit through and sets the
+// RateLimit-* headers, plus Retry-After on the rejected requests.
+func (l *Limiter) Middleware(h http.Handler) http.Handler {
+	return l.Handler(h, nil)
 }
 
-func (sc *ipRequestCount) get(key string) int {
-	sc.mu.Lock()
-	defer sc.mu.Unlock()
-	return sc.ips[key]
+// Handler is like Middleware, but the rejected requests are passed to the rejected handler,
+// which should respond with http.StatusTooManyRequests. If it is nil, a plain text error is written.
+func (l *Limiter) Handler(h, rejected http.Handler) http.Handler {
+	if rejected == nil {
+		rejected = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := l.backend.Take(r.Context(), l.clientKey(r))
+		if err != nil {
+			// Failing open is better than refusing every request while the backend is down.
+			log.Err(err).Msg("rate limiter backend failed, letting the request through")
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Policy", strconv.Itoa(res.Limit)+";w="+strconv.Itoa(int(res.Window.Seconds())))
+		header.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+		if !res.Allowed {
+			header.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(res.RetryAfter))))
+			rejected.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
-func readUserIP(r *http.Request) string {
-	IPAddress := r.Header.Get("X-Real-Ip")
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("X-Forwarded-For")
-	}
-	if IPAddress == "" {
-		IPAddress = r.RemoteAddr
-	}
-	return IPAddress
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
@@ -0,0 +1,106 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+var _ Backend = (*StoreBackend)(nil)
+
+// StoreBackend is a Backend that keeps the counters in a shared store, so every
+// replica using the same store enforces the same limit.
+//
+// It implements a sliding window: the requests of the current fixed window are
+// added to the ones of the previous window, weighted by how much of it still
+// overlaps with the sliding window. Only two counters per key are kept, and
+// they expire on their own. Only the allowed requests are counted.
+//
+// The counters expire by the time of the store, so the clock of StoreBackend has to agree with it,
+// it is only replaced by WithClock in the tests.
+type StoreBackend struct {
+	store  models.CounterStore
+	name   string
+	limit  int64
+	period time.Duration
+	clock  Clock
+}
+
+// NewStoreBackend returns a StoreBackend that allows up to requestLimit requests per requestPeriod for every key.
+// The name separates the counters of different limiters using the same store.
+// Only WithClock applies to it, there is nothing to clean up.
+func NewStoreBackend(store models.CounterStore, name string, requestLimit int, requestPeriod time.Duration, opts ...BackendOption) *StoreBackend {
+	o := backendOptions{clock: realClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &StoreBackend{
+		store:  store,
+		name:   name,
+		limit:  int64(requestLimit),
+		period: requestPeriod,
+		clock:  o.clock,
+	}
+}
+
+// Take counts the request in the current window if the sliding window is within the limit with it.
+func (sb *StoreBackend) Take(ctx context.Context, key string) (Result, error) {
+	now := sb.clock.Now()
+	windowStart := now.Truncate(sb.period)
+	windowEnd := windowStart.Add(sb.period)
+
+	// The request is counted first, so concurrent requests can't all pass the check,
+	// and the count is rolled back if it is rejected.
+	// The counter of a window has to outlive the next window, where it is the previous one.
+	currentKey := sb.counterKey(key, windowStart)
+	current, err := sb.store.IncrCounter(ctx, currentKey, windowEnd.Add(sb.period))
+	if err != nil {
+		return Result{}, err
+	}
+	previous, err := sb.store.Counter(ctx, sb.counterKey(key, windowStart.Add(-sb.period)))
+	if err != nil {
+		return Result{}, err
+	}
+
+	overlap := 1 - float64(now.Sub(windowStart))/float64(sb.period)
+	count := int64(math.Ceil(float64(previous)*overlap)) + current
+
+	res := Result{
+		Allowed: count <= sb.limit,
+		Limit:   int(sb.limit),
+		Window:  sb.period,
+		Reset:   windowEnd.Add(sb.period).Sub(now),
+	}
+	if !res.Allowed {
+		res.RetryAfter = sb.retryAfter(now, windowStart, previous, current)
+		if _, err := sb.store.DecrCounter(ctx, currentKey); err != nil {
+			return Result{}, err
+		}
+		count--
+	}
+	res.Remaining = int(max(0, sb.limit-count))
+
+	return res, nil
+}
+
+// retryAfter estimates when the next request would be allowed.
+func (sb *StoreBackend) retryAfter(now, windowStart time.Time, previous, current int64) time.Duration {
+	if current >= sb.limit || previous == 0 {
+		// Only the next window helps, where the current one becomes the previous one.
+		return windowStart.Add(sb.period).Sub(now)
+	}
+
+	// Wait until the weight of the previous window drops enough for one more request.
+	overlap := float64(sb.limit-current) / float64(previous)
+	at := windowStart.Add(time.Duration((1 - overlap) * float64(sb.period)))
+
+	return max(at.Sub(now), time.Second)
+}
+
+func (sb *StoreBackend) counterKey(key string, windowStart time.Time) string {
+	return "ratelimit:" + sb.name + ":" + key + ":" + strconv.FormatInt(windowStart.Unix(), 10)
+}
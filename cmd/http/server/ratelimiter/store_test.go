@@ -0,0 +1,76 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models/memory"
+)
+
+func TestStoreBackendOnlyCountsAllowedRequests(t *testing.T) {
+	ctx := context.Background()
+	store, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store expires the counters by the system time, so the clock stays close to it.
+	clock := &fakeClock{now: time.Now().Truncate(time.Hour).Add(30 * time.Minute)}
+	sb := NewStoreBackend(store, "test", 2, time.Hour, WithClock(clock))
+
+	for i := 0; i < 5; i++ {
+		res, err := sb.Take(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i < 2; res.Allowed != want {
+			t.Fatalf("request %d: Allowed = %v, want %v", i+1, res.Allowed, want)
+		}
+		if res.Remaining != 0 && i >= 1 {
+			t.Errorf("request %d: Remaining = %d, want 0", i+1, res.Remaining)
+		}
+	}
+
+	windowStart := clock.Now().Truncate(time.Hour)
+	got, err := store.Counter(ctx, sb.counterKey("a", windowStart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("counter = %d, want only the 2 allowed requests counted", got)
+	}
+}
+
+func TestStoreBackendSlidingWindow(t *testing.T) {
+	ctx := context.Background()
+	store, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Now().Truncate(time.Hour)}
+	sb := NewStoreBackend(store, "test", 2, time.Hour, WithClock(clock))
+
+	take := func() Result {
+		t.Helper()
+		res, err := sb.Take(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	take()
+	take()
+	if res := take(); res.Allowed || res.RetryAfter != time.Hour {
+		t.Fatalf("third request = %+v, want rejected until the next window", res)
+	}
+
+	// Half of the previous window still counts: 1 of its 2 requests.
+	clock.Advance(90 * time.Minute)
+	if res := take(); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("request in the next window = %+v, want allowed with nothing remaining", res)
+	}
+	if res := take(); res.Allowed || res.RetryAfter != 30*time.Minute {
+		t.Errorf("request over the limit = %+v, want rejected until the next window", res)
+	}
+}
@@ -0,0 +1,149 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+var _ Backend = (*TokenBucket)(nil)
+
+// BackendOption configures the TokenBucket or the StoreBackend.
+type BackendOption func(*backendOptions)
+
+type backendOptions struct {
+	clock           Clock
+	cleanupInterval time.Duration
+}
+
+// WithClock makes the backend use the given clock instead of the system time.
+func WithClock(c Clock) BackendOption {
+	return func(o *backendOptions) {
+		o.clock = c
+	}
+}
+
+// WithCleanupInterval sets how often the TokenBucket removes the idle buckets, it defaults to the request period.
+func WithCleanupInterval(d time.Duration) BackendOption {
+	return func(o *backendOptions) {
+		o.cleanupInterval = d
+	}
+}
+
+// TokenBucket is an in-process Backend that allows up to requestLimit requests per requestPeriod for every key.
+//
+// Every key has a bucket of requestLimit tokens, which refills continuously at
+// requestLimit/requestPeriod tokens per second, so there are no bursts at window boundaries.
+// A bucket that refilled completely is the same as a missing one, so it is removed.
+type TokenBucket struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	limit   float64
+	period  time.Duration
+	rate    float64 // tokens per second
+	clock   Clock
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket that removes the idle buckets in the background until ctx is canceled.
+func NewTokenBucket(ctx context.Context, requestLimit int, requestPeriod time.Duration, opts ...BackendOption) *TokenBucket {
+	o := backendOptions{clock: realClock{}, cleanupInterval: requestPeriod}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	tb := &TokenBucket{
+		buckets: make(map[string]*bucket),
+		limit:   float64(requestLimit),
+		period:  requestPeriod,
+		rate:    float64(requestLimit) / requestPeriod.Seconds(),
+		clock:   o.clock,
+	}
+
+	go tb.cleanup(ctx, o.cleanupInterval)
+
+	return tb
+}
+
+// Take takes a token from the bucket of the key, if there is one.
+func (tb *TokenBucket) Take(_ context.Context, key string) (Result, error) {
+	now := tb.clock.Now()
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.limit, last: now}
+		tb.buckets[key] = b
+	}
+	tb.refill(b, now)
+
+	res := Result{Limit: int(tb.limit), Window: tb.period}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = tb.durationFor(1 - b.tokens)
+	}
+	res.Remaining = int(math.Floor(b.tokens))
+	res.Reset = tb.durationFor(tb.limit - b.tokens)
+
+	return res, nil
+}
+
+// Len returns the amount of tracked keys.
+func (tb *TokenBucket) Len() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return len(tb.buckets)
+}
+
+// refill adds the tokens accumulated since the last refill, must be called with tb.mu held.
+func (tb *TokenBucket) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(tb.limit, b.tokens+elapsed*tb.rate)
+		b.last = now
+	}
+}
+
+// durationFor returns the time it takes to refill the given amount of tokens.
+func (tb *TokenBucket) durationFor(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / tb.rate * float64(time.Second))
+}
+
+func (tb *TokenBucket) cleanup(ctx context.Context, interval time.Duration) {
+	tt := time.NewTicker(interval)
+	defer tt.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tt.C:
+			tb.removeIdle()
+		}
+	}
+}
+
+// removeIdle removes the buckets that refilled completely.
+func (tb *TokenBucket) removeIdle() {
+	now := tb.clock.Now()
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	for key, b := range tb.buckets {
+		tb.refill(b, now)
+		if b.tokens >= tb.limit {
+			delete(tb.buckets, key)
+		}
+	}
+}
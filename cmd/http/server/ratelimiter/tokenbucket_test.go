@@ -0,0 +1,222 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func take(t *testing.T, tb *TokenBucket, key string) Result {
+	t.Helper()
+	res, err := tb.Take(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	tb := NewTokenBucket(ctx, 2, 10*time.Second, WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		if res := take(t, tb, "a"); !res.Allowed {
+			t.Fatalf("request %d was rejected within the limit", i+1)
+		}
+	}
+	res := take(t, tb, "a")
+	if res.Allowed {
+		t.Fatal("request over the limit was allowed")
+	}
+	if res.RetryAfter != 5*time.Second {
+		t.Errorf("RetryAfter = %v, want 5s for one token at 2 per 10s", res.RetryAfter)
+	}
+	if res := take(t, tb, "b"); !res.Allowed {
+		t.Error("the keys don't have separate buckets")
+	}
+
+	clock.Advance(5 * time.Second)
+	if res := take(t, tb, "a"); !res.Allowed {
+		t.Fatal("request was rejected after a token was refilled")
+	}
+	if res := take(t, tb, "a"); res.Allowed {
+		t.Fatal("more than one token was refilled in 5s")
+	}
+
+	// The bucket never holds more than the limit.
+	clock.Advance(time.Hour)
+	res = take(t, tb, "a")
+	if !res.Allowed || res.Remaining != 1 {
+		t.Errorf("after a long idle period got Allowed %v, Remaining %d, want true, 1", res.Allowed, res.Remaining)
+	}
+}
+
+func TestLimiterHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	l := NewLimiter(NewTokenBucket(ctx, 1, time.Minute, WithClock(clock)))
+	h := l.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		status  int
+		headers map[string]string
+	}{
+		{
+			name:   "allowed",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Policy":    "1;w=60",
+				"RateLimit-Limit":     "1",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "60",
+				"Retry-After":         "",
+			},
+		},
+		{
+			name:   "rejected",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "60",
+				"Retry-After":         "60",
+			},
+		},
+		{
+			name:    "rejected after half the period",
+			advance: 30 * time.Second,
+			status:  http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Reset": "30",
+				"Retry-After":     "30",
+			},
+		},
+		{
+			name:    "Retry-After is never 0",
+			advance: 29*time.Second + 900*time.Millisecond,
+			status:  http.StatusTooManyRequests,
+			headers: map[string]string{
+				"Retry-After": "1",
+			},
+		},
+		{
+			name:    "allowed after the refill",
+			advance: 100 * time.Millisecond,
+			status:  http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"Retry-After":         "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		w := serve()
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		for k, want := range tt.headers {
+			if got := w.Header().Get(k); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, want)
+			}
+		}
+	}
+}
+
+func TestTokenBucketRemovesIdleBuckets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	tb := NewTokenBucket(ctx, 1, time.Minute, WithClock(clock), WithCleanupInterval(time.Hour))
+
+	take(t, tb, "a")
+	clock.Advance(30 * time.Second)
+	take(t, tb, "b")
+
+	clock.Advance(30 * time.Second)
+	tb.removeIdle()
+	if n := tb.Len(); n != 1 {
+		t.Fatalf("Len() = %d after a refilled bucket was removed, want 1", n)
+	}
+
+	clock.Advance(30 * time.Second)
+	tb.removeIdle()
+	if n := tb.Len(); n != 0 {
+		t.Fatalf("Len() = %d after every bucket refilled, want 0", n)
+	}
+}
+
+func TestTokenBucketCleanupStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	tb := NewTokenBucket(ctx, 1, time.Minute, WithClock(clock), WithCleanupInterval(time.Millisecond))
+
+	take(t, tb, "a")
+	clock.Advance(time.Minute)
+	waitFor(t, func() bool { return tb.Len() == 0 })
+
+	cancel()
+	// Give the goroutine time to notice the cancellation.
+	time.Sleep(50 * time.Millisecond)
+
+	take(t, tb, "b")
+	clock.Advance(time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if n := tb.Len(); n != 1 {
+		t.Fatalf("Len() = %d, the idle bucket was removed after ctx was canceled", n)
+	}
+}
+
+// waitFor polls cond until it's true, or fails the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -4,16 +4,19 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
 	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/cmd/http/server/metrics"
 	"github.com/handsomefox/gowarp/cmd/http/server/ratelimiter"
 	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/breaker"
 	"github.com/handsomefox/gowarp/internal/models"
-	"github.com/handsomefox/gowarp/internal/models/mongo"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
 )
@@ -24,36 +27,118 @@ var (
 	ErrFetchingConfiguration = errors.New("server: error fetching configuration")
 	ErrCreateKey             = errors.New("server: failed to create a key on the fly")
 	ErrUnexpectedBody        = errors.New("server: unexpected configuration response body")
+	ErrNoTokenStore          = errors.New("server: authentication requires the token and counter stores")
+	ErrNoCounterStore        = errors.New("server: the shared rate limit requires the counter store")
 )
 
 type Server struct {
-	client *client.Client
-	db     *mongo.AccountModel
-	mux    *chi.Mux
-	tmpls  templates.Map
+	client     *client.Client
+	db         models.AccountStore
+	mux        *chi.Mux
+	tmpls      templates.Map
+	cfg        Config
+	keyLimiter *ratelimiter.Limiter
+	metrics    *metrics.Metrics
+	// upstream guards the calls to the upstream API made to generate the keys.
+	upstream *breaker.Breaker
+
+	// stop cancels the context of the background goroutines, wg waits for them.
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	httpSrv *http.Server
 }
 
-type DBParams struct {
-	DBConnString string
-	DBName       string
-	DBCollName   string
+// Config holds the tunables of the server, zero values are replaced with the defaults.
+type Config struct {
+	// LeaseTimeout is how long a handed out key stays leased before it returns to the pool
+	// if the delivery was not confirmed.
+	LeaseTimeout time.Duration
+	// ReapInterval is how often the expired leases are returned to the pool
+	// and the delivered keys are purged.
+	ReapInterval time.Duration
+	// DeliveredRetention is how long a delivered key is kept before it is purged.
+	DeliveredRetention time.Duration
+	// RequireAuth makes the key handouts require a bearer token, see RequireToken.
+	// The tokens are looked up in Tokens and their usage is counted in Counters.
+	RequireAuth bool
+	// Tokens is the store of the API tokens, it is only required by RequireAuth.
+	Tokens models.TokenStore
+	// Counters keeps the token usage and the shared rate limiting counters,
+	// it is only required by RequireAuth and SharedRateLimit.
+	Counters models.CounterStore
+	// TrustedProxies are the networks of the reverse proxies whose forwarding headers
+	// are used to find the client IP for the rate limiting.
+	TrustedProxies []netip.Prefix
+	// SharedRateLimit keeps the rate limiting counters in the database instead of the process,
+	// so the limit holds across every replica using the same database.
+	SharedRateLimit bool
+	// MinPoolSize is the pool size below which the server reports itself as not ready.
+	MinPoolSize int64
+	// Fill controls the background filler, zero fields are taken from DefaultFillPolicy.
+	Fill FillPolicy
+	// ClientOptions are passed to the upstream client, e.g. client.WithConfiguration
+	// to talk to the fake upstream of the clienttest package.
+	ClientOptions []client.Option
+}
+
+func (c Config) withDefaults() Config {
+	c.Fill = c.Fill.withDefaults()
+	if c.LeaseTimeout <= 0 {
+		c.LeaseTimeout = 2 * time.Minute
+	}
+	if c.ReapInterval <= 0 {
+		c.ReapInterval = 30 * time.Second
+	}
+	if c.DeliveredRetention <= 0 {
+		c.DeliveredRetention = 24 * time.Hour
+	}
+	return c
 }
 
 // New returns a *Server with all the required setup done.
-func New(ctx context.Context, dbParams DBParams, tmpls templates.Map) (*Server, error) {
-	// Connect to the database
-	db, err := mongo.NewAccountModel(ctx, dbParams.DBConnString, dbParams.DBName, dbParams.DBCollName)
-	if err != nil {
-		return nil, ErrConnStr
+// The db is used to store the pool of generated keys, it is closed by Shutdown.
+// The background work keeps running until Shutdown, even if ctx is canceled earlier.
+func New(ctx context.Context, db models.AccountStore, tmpls templates.Map, cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Fill.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.RequireAuth && (cfg.Tokens == nil || cfg.Counters == nil) {
+		return nil, ErrNoTokenStore
+	}
+	if cfg.SharedRateLimit && cfg.Counters == nil {
+		return nil, ErrNoCounterStore
 	}
+	ctx, stop := context.WithCancel(context.WithoutCancel(ctx))
+
+	m := metrics.New(func() float64 {
+		return float64(db.Len(ctx))
+	})
 
 	// Create the server
 	server := &Server{
-		client: client.NewClient(true),
-		db:     db,
-		tmpls:  tmpls,
+		client:   client.NewClient(true, append(cfg.ClientOptions, client.WithTimingObserver(m.ObserveClientCall))...),
+		db:       db,
+		tmpls:    tmpls,
+		cfg:      cfg,
+		metrics:  m,
+		upstream: breaker.New(),
+		stop:     stop,
 	}
 
+	// Shared by every route that hands out keys.
+	var limiterBackend ratelimiter.Backend
+	if cfg.SharedRateLimit {
+		limiterBackend = ratelimiter.NewStoreBackend(cfg.Counters, "keys", 20, 1*time.Hour)
+	} else {
+		limiterBackend = ratelimiter.NewTokenBucket(ctx, 20, 1*time.Hour)
+	}
+	server.keyLimiter = ratelimiter.NewLimiter(limiterBackend,
+		ratelimiter.WithTrustedProxies(cfg.TrustedProxies),
+	)
+
 	// Setup routing
 	r := chi.NewRouter()
 
@@ -70,21 +155,69 @@ func New(ctx context.Context, dbParams DBParams, tmpls templates.Map) (*Server,
 		"/",
 		server.HandleHomePage(),
 	)
+	r.Handle(
+		"/metrics",
+		m.Handler(),
+	)
+	r.Get(
+		"/healthz",
+		server.HandleLiveness(),
+	)
+	r.Get(
+		"/readyz",
+		server.HandleReadiness(),
+	)
 
-	r.HandleFunc(
+	r.Handle(
 		"/key/generate",
-		ratelimiter.New(server.HandleGenerateKey(), 20, 1*time.Hour),
+		server.keyLimiter.Handler(
+			server.RequireToken(server.HandleGenerateKey()),
+			server.WrapHandlerFuncErr(server.rejectRateLimited),
+		),
+	)
+	r.Handle(
+		"/key/config",
+		server.keyLimiter.Handler(
+			server.RequireToken(server.HandleWireGuardConfig()),
+			server.WrapHandlerFuncErr(server.rejectRateLimited),
+		),
+	)
+	r.Handle(
+		"/key/qr",
+		server.keyLimiter.Handler(
+			server.RequireToken(server.HandleWireGuardQRCode()),
+			server.WrapHandlerFuncErr(server.rejectRateLimited),
+		),
 	)
 
+	r.Mount("/api/v1", server.APIv1())
+
 	server.mux = r
 
 	// Start a goroutine to generate keys in the background if necessary.
-	go server.Fill(ctx, 200, 20*time.Minute)
+	server.goBackground(func() { server.Fill(ctx) })
+	// Start a goroutine to return the keys with expired leases to the pool.
+	server.goBackground(func() { server.ReapLeases(ctx) })
 
 	return server, nil
 }
 
+// goBackground runs f in a goroutine that Shutdown waits for.
+func (s *Server) goBackground(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// ServeHTTP serves the routes of the server, e.g. behind an httptest.Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
 // ListenAndServe is a wrapper around (*http.Server).ListenAndServe().
+// It returns nil once the server was stopped by Shutdown, or right away if Shutdown was called before.
 func (s *Server) ListenAndServe(listenAddr string) error {
 	srv := &http.Server{
 		Addr:              listenAddr,
@@ -94,43 +227,193 @@ func (s *Server) ListenAndServe(listenAddr string) error {
 		ReadHeaderTimeout: 1 * time.Minute,
 	}
 
-	return srv.ListenAndServe()
+	s.mu.Lock()
+	if s.httpSrv != nil {
+		// Shutdown ran first.
+		s.mu.Unlock()
+		return nil
+	}
+	s.httpSrv = srv
+	s.mu.Unlock()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
 }
 
-// Fill fills the db to the maxCount.
-func (s *Server) Fill(ctx context.Context, maxCount int64, sleepDuration time.Duration) {
-	tt := time.NewTicker(time.Second * 30)
+// Shutdown gracefully stops the server: it waits for the in-flight requests to finish,
+// then stops the background filler, reaper and rate limiter, and closes the database.
+// If ctx ends before that, the remaining steps are still attempted and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	s.mu.Lock()
+	srv := s.httpSrv
+	if srv == nil {
+		// Never started, make ListenAndServe return right away if it is called later.
+		s.httpSrv = &http.Server{}
+	}
+	s.mu.Unlock()
+
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	s.stop()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	closeCtx := ctx
+	if ctx.Err() != nil {
+		// Still give the database a chance to flush its state.
+		var cancel context.CancelFunc
+		closeCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+	}
+	if err := s.db.Close(closeCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Fill keeps the pool stocked according to the configured FillPolicy, until ctx is canceled.
+func (s *Server) Fill(ctx context.Context) {
+	policy := s.cfg.Fill
+	tt := time.NewTicker(policy.Interval)
 	defer tt.Stop()
-	for range tt.C {
-		if s.db.Len(ctx) >= maxCount*4 {
-			time.Sleep(sleepDuration)
+
+	filling := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tt.C:
+		}
+
+		size := s.db.Len(ctx)
+		switch {
+		case size >= policy.HighWatermark:
+			filling = false
+			log.Info().Int64("current_key_count", size).Dur("backoff", policy.Backoff).Msg("the pool is full, backing off")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(policy.Backoff):
+			}
+			continue
+		case size >= policy.Target:
+			filling = false
+			continue
+		case size < policy.LowWatermark:
+			filling = true
 		}
+		if !filling {
+			continue
+		}
+
 		s.pushNewKeyToDatabase(ctx)
 		log.Info().Int64("current_key_count", s.db.Len(ctx)).Send()
 	}
 }
 
-// GetKey either returns a key that is already stored or creates a new one.
+// GetKey either leases a key that is already stored or creates a new one.
+// A leased key has to be confirmed with ConfirmKey once it was delivered, or released
+// with ReleaseKey if the delivery failed. Otherwise it returns to the pool when the lease ends.
 func (s *Server) GetKey(ctx context.Context) (*models.Account, error) {
-	item, err := s.db.GetAny(ctx)
+	item, err := s.db.Lease(ctx, s.cfg.LeaseTimeout)
 	if err != nil {
-		key, err := s.client.NewAccountWithLicense(ctx)
+		key, err := s.newAccountWithLicense(ctx)
 		if err != nil {
+			if errors.Is(err, breaker.ErrOpen) {
+				log.Debug().Msg("the pool is empty and the upstream is unavailable")
+				return nil, ErrCreateKey
+			}
+			s.metrics.ObserveGeneration(err)
 			log.Err(err).Send()
 			return nil, ErrCreateKey
 		}
+		s.metrics.ObserveGeneration(nil)
 
 		return key, nil
 	}
 
-	if err := s.db.Delete(ctx, item.ID); err != nil {
-		log.Err(err).Msg("failed to remove key from the database")
-	}
-
 	log.Info().Int64("current_key_count", s.db.Len(ctx)).Send()
 	return item, nil
 }
 
+// ConfirmKey marks the key returned by GetKey as delivered.
+func (s *Server) ConfirmKey(ctx context.Context, key *models.Account) {
+	if key.ID == nil { // created on the fly, never was in the pool
+		s.metrics.Handouts.WithLabelValues(metrics.SourceGenerated).Inc()
+		return
+	}
+	s.metrics.Handouts.WithLabelValues(metrics.SourcePool).Inc()
+	if err := s.db.Confirm(context.WithoutCancel(ctx), key.ID); err != nil {
+		log.Err(err).Any("id", key.ID).Msg("failed to confirm the key delivery")
+	}
+}
+
+// ReleaseKey puts the key returned by GetKey back into the pool.
+func (s *Server) ReleaseKey(ctx context.Context, key *models.Account) {
+	if key.ID == nil { // created on the fly, never was in the pool
+		return
+	}
+	if err := s.db.Release(context.WithoutCancel(ctx), key.ID); err != nil {
+		log.Err(err).Any("id", key.ID).Msg("failed to release the key")
+	}
+}
+
+// ReapLeases periodically returns the keys with expired leases to the pool,
+// and purges the keys delivered more than DeliveredRetention ago.
+func (s *Server) ReapLeases(ctx context.Context) {
+	tt := time.NewTicker(s.cfg.ReapInterval)
+	defer tt.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tt.C:
+			if n, err := s.db.ExpireLeases(ctx, now); err != nil {
+				log.Err(err).Msg("failed to expire the leases")
+			} else if n > 0 {
+				log.Info().Int64("expired_leases", n).Msg("returned keys with expired leases to the pool")
+			}
+
+			if n, err := s.db.PurgeDelivered(ctx, now.Add(-s.cfg.DeliveredRetention)); err != nil {
+				log.Err(err).Msg("failed to purge the delivered keys")
+			} else if n > 0 {
+				log.Info().Int64("purged_keys", n).Msg("purged the delivered keys")
+			}
+		}
+	}
+}
+
+// newAccountWithLicense calls client.NewAccountWithLicense through the circuit breaker,
+// it returns breaker.ErrOpen without calling the upstream while it is failing.
+func (s *Server) newAccountWithLicense(ctx context.Context) (*models.Account, error) {
+	var acc *models.Account
+	err := s.upstream.Do(ctx, func() error {
+		var err error
+		acc, err = s.client.NewAccountWithLicense(ctx)
+		return err
+	})
+
+	return acc, err
+}
+
 // pushNewKeyToDatabase wraps the client.NewAccountWithLicense and stores the key inside database.
 func (s *Server) pushNewKeyToDatabase(ctx context.Context) {
 	var (
@@ -138,8 +421,12 @@ func (s *Server) pushNewKeyToDatabase(ctx context.Context) {
 		createdKey *models.Account
 	)
 	errg.Go(func() error {
-		key, err := s.client.NewAccountWithLicense(ctx)
+		key, err := s.newAccountWithLicense(ctx)
 		if err != nil {
+			if errors.Is(err, breaker.ErrOpen) {
+				return err
+			}
+			s.metrics.ObserveGeneration(err)
 			return ErrGetKey
 		}
 		createdKey = key
@@ -147,19 +434,26 @@ func (s *Server) pushNewKeyToDatabase(ctx context.Context) {
 	})
 
 	if err := errg.Wait(); err != nil {
+		if errors.Is(err, breaker.ErrOpen) {
+			log.Debug().Time("retry_at", s.upstream.Status().RetryAt).Msg("the upstream is unavailable, skipping the fill")
+			return
+		}
 		log.Err(err).Send()
 		return
 	}
 
 	i, err := createdKey.RefCount.Int64()
 	if err != nil {
+		s.metrics.ObserveGeneration(err)
 		log.Err(err).Msg("couldn't get generated key size")
 		return
 	}
 	if i < 1000 {
+		s.metrics.ObserveGeneration(metrics.ErrKeyTooSmall)
 		log.Error().Int64("key_size", i).Msg("generated key was too small to use")
 		return
 	}
+	s.metrics.ObserveGeneration(nil)
 
 	id, err := s.db.Insert(ctx, createdKey)
 	if err != nil {
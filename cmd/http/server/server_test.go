@@ -0,0 +1,440 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/client/clienttest"
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/auth"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/handsomefox/gowarp/internal/models/memory"
+)
+
+// newTestServer returns a server with an empty in-memory pool that talks to a fake upstream.
+func newTestServer(t *testing.T, cfg Config) (*Server, *clienttest.Server, *memory.AccountModel) {
+	t.Helper()
+
+	db, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, fake := newTestServerWithStore(t, db, cfg)
+
+	return s, fake, db
+}
+
+// newTestServerWithStore returns a server with the given pool that talks to a fake upstream.
+func newTestServerWithStore(t *testing.T, db models.AccountStore, cfg Config) (*Server, *clienttest.Server) {
+	t.Helper()
+
+	fake := clienttest.NewServer()
+	t.Cleanup(fake.Close)
+
+	tmpls, err := templates.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ClientOptions = append(cfg.ClientOptions, client.WithConfiguration(fake.Configuration()))
+	s, err := New(context.Background(), db, tmpls, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return s, fake
+}
+
+// do sends the request to the server and returns the response.
+func do(s *Server, method, target, accept string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) *T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body.String(), err)
+	}
+	return &v
+}
+
+func TestGetKey(t *testing.T) {
+	ctx := context.Background()
+	s, fake, db := newTestServer(t, Config{})
+
+	id, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: "pooled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := s.GetKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != id || key.License != "pooled" {
+		t.Fatalf("GetKey() = %+v, want the pooled key", key)
+	}
+	s.ConfirmKey(ctx, key)
+	if err := db.Release(ctx, id); err == nil {
+		t.Error("the confirmed key is still in the pool")
+	}
+
+	key, err = s.GetKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != nil || key.License == "" {
+		t.Fatalf("GetKey() = %+v, want a key generated on the fly", key)
+	}
+	if fake.Requests(clienttest.EndpointRegister) == 0 {
+		t.Error("the upstream was not called for an empty pool")
+	}
+	if n := fake.Devices(); n != 0 {
+		t.Errorf("%d devices are left registered by the generation, want 0", n)
+	}
+}
+
+func TestHandleGenerateKey(t *testing.T) {
+	s, _, _ := newTestServer(t, Config{})
+
+	w := do(s, http.MethodGet, "/key/generate", "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	key := decode[KeyResponse](t, w)
+	if key.License == "" {
+		t.Fatal("license is empty")
+	}
+
+	w = do(s, http.MethodGet, "/key/generate", "text/html")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	if !strings.Contains(w.Body.String(), "Your key is here!") {
+		t.Errorf("the key page was not rendered:\n%s", w.Body)
+	}
+}
+
+func TestHandleAPICreateKey(t *testing.T) {
+	s, fake, _ := newTestServer(t, Config{})
+
+	w := do(s, http.MethodPost, "/api/v1/keys", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if key := decode[KeyResponse](t, w); key.License == "" {
+		t.Fatal("license is empty")
+	}
+
+	fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Status: http.StatusInternalServerError})
+	w = do(s, http.MethodPost, "/api/v1/keys", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	if e := decode[APIError](t, w); e.Status != http.StatusServiceUnavailable || e.Err == "" {
+		t.Errorf("error body = %+v", e)
+	}
+}
+
+func TestHandleWireGuardConfig(t *testing.T) {
+	s, fake, _ := newTestServer(t, Config{})
+
+	w := do(s, http.MethodGet, "/key/config", "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	resp := decode[ConfigResponse](t, w)
+	if resp.License == "" {
+		t.Error("license is empty")
+	}
+	if !strings.Contains(resp.Config, "PublicKey = "+clienttest.PeerPublicKey) {
+		t.Errorf("config doesn't contain the peer:\n%s", resp.Config)
+	}
+	if n := fake.Devices(); n != 1 {
+		t.Errorf("%d devices are registered, want the device of the config only", n)
+	}
+
+	w = do(s, http.MethodGet, "/key/config", "text/html")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "[Interface]") {
+		t.Errorf("the config page doesn't show the config:\n%s", w.Body)
+	}
+}
+
+func TestRequireTokenQuota(t *testing.T) {
+	ctx := context.Background()
+	tokens, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, fake, _ := newTestServer(t, Config{RequireAuth: true, Tokens: tokens, Counters: tokens})
+
+	secret, tok, err := auth.Issue(ctx, tokens, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearer := []string{"Authorization", "Bearer " + secret}
+
+	if w := do(s, http.MethodPost, "/api/v1/keys", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status without a token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// A failed handout gives the reserved key back.
+	fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Status: http.StatusInternalServerError})
+	if w := do(s, http.MethodPost, "/api/v1/keys", "", bearer...); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	fake.ClearFaults()
+
+	if w := do(s, http.MethodPost, "/api/v1/keys", "", bearer...); w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/api/v1/keys", "", bearer...); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status over the quota = %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+
+	used, err := tokens.Counter(ctx, auth.UsageKey(tok.ID, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 1 {
+		t.Errorf("usage = %d, want only the handed out key counted", used)
+	}
+}
+
+func TestDeliverKeyReleasesOnRenderFailure(t *testing.T) {
+	ctx := context.Background()
+	s, _, db := newTestServer(t, Config{})
+
+	id, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: "pooled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page can't be rendered, the key page has no such field.
+	s.tmpls[templates.KeyID] = template.Must(template.New("key").Parse("{{.Missing}}"))
+
+	w := do(s, http.MethodGet, "/key/generate", "text/html")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	if n := db.Len(ctx); n != 1 {
+		t.Fatalf("pool size = %d, want the key released", n)
+	}
+
+	key, err := db.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != id {
+		t.Errorf("leased %v, want the released key %v", key.ID, id)
+	}
+}
+
+// purgeCounter counts the accounts purged from the store.
+type purgeCounter struct {
+	*memory.AccountModel
+	purged atomic.Int64
+}
+
+func (p *purgeCounter) PurgeDelivered(ctx context.Context, before time.Time) (int64, error) {
+	n, err := p.AccountModel.PurgeDelivered(ctx, before)
+	p.purged.Add(n)
+	return n, err
+}
+
+func TestReapLeases(t *testing.T) {
+	ctx := context.Background()
+	mem, err := memory.NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &purgeCounter{AccountModel: mem}
+	s, _ := newTestServerWithStore(t, db, Config{
+		LeaseTimeout:       time.Millisecond,
+		ReapInterval:       10 * time.Millisecond,
+		DeliveredRetention: time.Millisecond,
+	})
+
+	for _, license := range []string{"lost", "delivered"} {
+		if _, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: license}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One key is never confirmed, the other one is delivered.
+	for i := 0; i < 2; i++ {
+		key, err := s.GetKey(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.License == "delivered" {
+			s.ConfirmKey(ctx, key)
+		}
+	}
+	if n := db.Len(ctx); n != 0 {
+		t.Fatalf("pool size = %d, want both keys handed out", n)
+	}
+
+	waitFor(t, "the expired lease to return to the pool", func() bool { return db.Len(ctx) == 1 })
+	waitFor(t, "the delivered key to be purged", func() bool { return db.purged.Load() == 1 })
+
+	key, err := db.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.License != "lost" || key.State != models.StateLeased {
+		t.Errorf("leased %+v, want the key with the expired lease", key)
+	}
+}
+
+// waitFor polls cond until it is true, or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestMetricsCounters(t *testing.T) {
+	ctx := context.Background()
+	s, fake, db := newTestServer(t, Config{})
+
+	if _, err := db.Insert(ctx, &models.Account{Type: "limited", RefCount: "1000", License: "pooled"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if w := do(s, http.MethodPost, "/api/v1/keys", ""); w.Code != http.StatusCreated {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+	}
+	fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Status: http.StatusInternalServerError})
+	if w := do(s, http.MethodPost, "/api/v1/keys", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+
+	w := do(s, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	for _, want := range []string{
+		`gowarp_handouts_total{source="pool"} 1`,
+		`gowarp_handouts_total{source="generated"} 2`,
+		`gowarp_generation_attempts_total 3`,
+		`gowarp_generation_successes_total 2`,
+		`gowarp_generation_failures_total{error="ErrRegAccount"} 1`,
+		`gowarp_pool_size 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("the metrics don't contain %q", want)
+		}
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s, fake, _ := newTestServer(t, Config{})
+	addr := freeAddr(t)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe(addr) }()
+	waitFor(t, "the server to listen", func() bool {
+		res, err := http.Get("http://" + addr + "/healthz")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return true
+	})
+
+	// The key is generated on the fly, slowly.
+	fake.Inject(clienttest.EndpointRegister, clienttest.Fault{Latency: 200 * time.Millisecond, Times: 1})
+	resc := make(chan int, 1)
+	go func() {
+		res, err := http.Post("http://"+addr+"/api/v1/keys", "", nil)
+		if err != nil {
+			t.Error(err)
+			resc <- 0
+			return
+		}
+		res.Body.Close()
+		resc <- res.StatusCode
+	}()
+	waitFor(t, "the request to reach the upstream", func() bool {
+		return fake.Requests(clienttest.EndpointRegister) > 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-resc; status != http.StatusCreated {
+		t.Errorf("status of the in-flight request = %d, want %d", status, http.StatusCreated)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("ListenAndServe() = %v, want nil after Shutdown", err)
+	}
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Error("the server still accepts connections after Shutdown")
+	}
+}
+
+func TestListenAndServeAfterShutdown(t *testing.T) {
+	s, _, _ := newTestServer(t, Config{})
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddr(t)
+	if err := s.ListenAndServe(addr); err != nil {
+		t.Errorf("ListenAndServe() after Shutdown = %v, want nil", err)
+	}
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Error("the server listens after Shutdown")
+	}
+}
+
+// freeAddr returns a local address that nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
@@ -1,6 +1,7 @@
 package templates
 
 import (
+	"fmt"
 	"html/template"
 )
 
@@ -16,6 +17,18 @@ const (
 
 type Map map[TemplateID]*template.Template
 
+type tmplFile struct {
+	name string
+	id   TemplateID
+}
+
+var files = []tmplFile{
+	{name: "home.html", id: HomeID},
+	{name: "error.html", id: ErrorID},
+	{name: "config.html", id: ConfigID},
+	{name: "key.html", id: KeyID},
+}
+
 func Load() (Map, error) {
 	const (
 		basePath   = "./assets/html/"
@@ -23,16 +36,6 @@ func Load() (Map, error) {
 		footerFile = basePath + "footer.html"
 	)
 	templates := make(map[TemplateID]*template.Template)
-	type TmplFile struct {
-		name string
-		id   TemplateID
-	}
-	files := []TmplFile{
-		{name: "home.html", id: HomeID},
-		{name: "error.html", id: ErrorID},
-		{name: "config.html", id: ConfigID},
-		{name: "key.html", id: KeyID},
-	}
 	for _, f := range files {
 		tmpl, err := template.ParseFiles(basePath+f.name, baseFile, footerFile)
 		if err != nil {
@@ -42,3 +45,13 @@ func Load() (Map, error) {
 	}
 	return templates, nil
 }
+
+// Check returns an error naming the first template that is missing from the map.
+func (m Map) Check() error {
+	for _, f := range files {
+		if m[f.id] == nil {
+			return fmt.Errorf("templates: %s is not loaded", f.name)
+		}
+	}
+	return nil
+}
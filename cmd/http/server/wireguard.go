@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/handsomefox/gowarp/client"
+	"github.com/handsomefox/gowarp/cmd/http/server/templates"
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrCreateConfig = &APIError{Err: "failed to create the WireGuard config", Status: http.StatusServiceUnavailable}
+
+// ConfigResponse is a key from the pool together with the WireGuard config of a device using it.
+type ConfigResponse struct {
+	KeyResponse
+	Config string `json:"config"`
+}
+
+// NewDevice registers a device with the license through the circuit breaker
+// and returns it, the device stays registered.
+func (s *Server) NewDevice(ctx context.Context, license string) (*client.Account, error) {
+	var dev *client.Account
+	err := s.upstream.Do(ctx, func() error {
+		var err error
+		dev, err = s.client.NewDevice(ctx, license)
+		return err
+	})
+
+	return dev, err
+}
+
+// HandleWireGuardConfig hands out a key like HandleGenerateKey, together with the
+// WireGuard config of a new device registered with it.
+func (s *Server) HandleWireGuardConfig() http.HandlerFunc {
+	return s.WrapHandlerFuncErr(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		key, resp, err := s.newConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		if wantsJSON(r) {
+			return s.deliverKey(ctx, w, key, http.StatusOK, renderJSON(resp))
+		}
+
+		return s.deliverKey(ctx, w, key, http.StatusOK, s.renderTemplate(templates.ConfigID, resp))
+	})
+}
+
+// newConfig leases a key and registers a new device with it. The key is released
+// if the device can't be registered, otherwise it has to be delivered by the caller.
+func (s *Server) newConfig(ctx context.Context) (*models.Account, *ConfigResponse, error) {
+	key, err := s.GetKey(ctx)
+	if err != nil {
+		log.Err(err).Msg("error getting the key")
+		return nil, nil, ErrAPIGetKey
+	}
+
+	dev, err := s.NewDevice(ctx, key.License)
+	if err != nil {
+		log.Err(err).Msg("failed to register a device")
+		s.ReleaseKey(ctx, key)
+		return nil, nil, ErrCreateConfig
+	}
+
+	conf, err := dev.WireGuardConfig()
+	if err != nil {
+		log.Err(err).Str("device", dev.ID).Msg("failed to render the WireGuard config")
+		s.ReleaseKey(ctx, key)
+		return nil, nil, ErrCreateConfig
+	}
+
+	return key, &ConfigResponse{KeyResponse: *NewKeyResponse(key), Config: conf}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/auth"
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+const tokenUsage = `Usage: gowarp-serve token <command> [arguments]
+
+Commands:
+  issue  -name NAME [-quota N]   issue a new token, N keys per day (0 means unlimited)
+  revoke ID                      revoke the token with the given id
+  list                           list the tokens with their usage for today
+`
+
+var errUsage = errors.New("invalid usage")
+
+// checkTokenStore refuses the memory backend for the token command: the tokens issued into it
+// are lost on exit, or overwritten by the snapshot of a running server sharing the file.
+func checkTokenStore(databaseURI string) error {
+	u, err := url.Parse(databaseURI)
+	if err != nil {
+		return fmt.Errorf("invalid DB_URI: %w", err)
+	}
+	if u.Scheme == "memory" {
+		return errors.New("the token command needs a persistent DB_URI (sqlite or mongodb), memory:// does not keep the tokens")
+	}
+	return nil
+}
+
+// runTokenCommand implements the "token" subcommand used to manage the API tokens.
+func runTokenCommand(ctx context.Context, db models.Store, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "issue":
+		fs := flag.NewFlagSet("token issue", flag.ContinueOnError)
+		name := fs.String("name", "", "name of the token owner")
+		quota := fs.Int64("quota", 0, "keys per day, 0 means unlimited")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		if *name == "" || *quota < 0 {
+			fmt.Fprint(os.Stderr, tokenUsage)
+			return errUsage
+		}
+
+		secret, t, err := auth.Issue(ctx, db, *name, *quota)
+		if err != nil {
+			return fmt.Errorf("failed to issue the token: %w", err)
+		}
+		fmt.Fprintf(out, "id:    %s\ntoken: %s\n", t.ID, secret)
+		fmt.Fprintln(out, "The token is only shown once, store it securely.")
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, tokenUsage)
+			return errUsage
+		}
+		if err := db.RevokeToken(ctx, args[1]); err != nil {
+			return fmt.Errorf("failed to revoke the token: %w", err)
+		}
+		fmt.Fprintf(out, "revoked %s\n", args[1])
+
+	case "list":
+		tokens, err := db.ListTokens(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list the tokens: %w", err)
+		}
+
+		now := time.Now()
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tQUOTA\tUSED TODAY\tCREATED\tREVOKED")
+		for i := range tokens {
+			t := &tokens[i]
+			used, err := db.Counter(ctx, auth.UsageKey(t.ID, now))
+			if err != nil {
+				return fmt.Errorf("failed to get the token usage: %w", err)
+			}
+			quota, revoked := "unlimited", "-"
+			if t.DailyQuota > 0 {
+				quota = fmt.Sprint(t.DailyQuota)
+			}
+			if t.Revoked() {
+				revoked = t.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n",
+				t.ID, t.Name, quota, used, t.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return tw.Flush()
+
+	default:
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return errUsage
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+// Package auth issues and checks the API tokens used to authenticate the users of the server.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+const tokenPrefix = "gw_"
+
+var (
+	ErrInvalidToken  = errors.New("auth: invalid token")
+	ErrRevokedToken  = errors.New("auth: token was revoked")
+	ErrQuotaExceeded = errors.New("auth: daily quota exceeded")
+)
+
+// Issue creates a new token and stores its hash. The returned secret is the only
+// place where the token itself is available, it can't be recovered from the store.
+// A dailyQuota of 0 means the token is not limited.
+func Issue(ctx context.Context, store models.TokenStore, name string, dailyQuota int64) (secret string, t *models.Token, err error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	rnd, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = tokenPrefix + rnd
+
+	t = &models.Token{
+		ID:         id,
+		Name:       name,
+		Hash:       Hash(secret),
+		DailyQuota: dailyQuota,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := store.InsertToken(ctx, t); err != nil {
+		return "", nil, err
+	}
+
+	return secret, t, nil
+}
+
+// Authenticate returns the token matching the secret, unless it doesn't exist or was revoked.
+func Authenticate(ctx context.Context, store models.TokenStore, secret string) (*models.Token, error) {
+	if secret == "" {
+		return nil, ErrInvalidToken
+	}
+
+	t, err := store.GetTokenByHash(ctx, Hash(secret))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if t.Revoked() {
+		return nil, ErrRevokedToken
+	}
+
+	return t, nil
+}
+
+// Reserve counts a key handed out to the token on the day of now and returns the usage for that day.
+// The key is counted before it is handed out, so concurrent requests can't go over the quota: if the
+// token already used up its quota, the count is rolled back and ErrQuotaExceeded is returned.
+// A reserved key that ends up not being handed out has to be given back with Release.
+func Reserve(ctx context.Context, store models.CounterStore, t *models.Token, now time.Time) (used int64, err error) {
+	key := UsageKey(t.ID, now)
+	day := now.UTC().Truncate(24 * time.Hour)
+	// Keep the counters around for a while, so the usage history can be inspected.
+	used, err = store.IncrCounter(ctx, key, day.Add(usageRetention))
+	if err != nil {
+		return 0, err
+	}
+
+	if t.DailyQuota > 0 && used > t.DailyQuota {
+		if _, err := store.DecrCounter(ctx, key); err != nil {
+			return 0, err
+		}
+		return used - 1, ErrQuotaExceeded
+	}
+
+	return used, nil
+}
+
+// Release gives back a key reserved with Reserve on the day of now, because it was not handed out.
+func Release(ctx context.Context, store models.CounterStore, t *models.Token, now time.Time) error {
+	_, err := store.DecrCounter(ctx, UsageKey(t.ID, now))
+	return err
+}
+
+// usageRetention is how long the daily usage counters are kept.
+const usageRetention = 30 * 24 * time.Hour
+
+// UsageKey is the key of the counter holding the usage of the token on the day of now.
+func UsageKey(tokenID string, now time.Time) string {
+	return "usage:" + tokenID + ":" + now.UTC().Format(time.DateOnly)
+}
+
+// Hash returns the hash of the token that is kept in the store.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
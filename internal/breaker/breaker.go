@@ -0,0 +1,214 @@
+// Package breaker implements a circuit breaker with exponential backoff and jitter.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Do while the circuit is open.
+var ErrOpen = errors.New("breaker: circuit is open")
+
+// State is the state of the circuit.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// Open rejects every call until the backoff ends.
+	Open
+	// HalfOpen lets a single probe call through, its outcome closes or reopens the circuit.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Option configures the Breaker.
+type Option func(*Breaker)
+
+// WithThreshold sets the amount of consecutive failures that open the circuit, it defaults to 5.
+func WithThreshold(n int) Option {
+	return func(b *Breaker) {
+		b.threshold = n
+	}
+}
+
+// WithBackoff sets how long the circuit stays open the first time, and the upper bound
+// of the doubling backoff on the following reopenings. It defaults to 30 seconds and 30 minutes.
+func WithBackoff(base, maxBackoff time.Duration) Option {
+	return func(b *Breaker) {
+		b.baseBackoff = base
+		b.maxBackoff = maxBackoff
+	}
+}
+
+// WithClock makes the breaker use the given function instead of time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// Breaker stops calling a failing dependency for a while, instead of failing on every call.
+//
+// After threshold consecutive failures the circuit opens for a backoff, which doubles
+// every time a probe fails, up to the maximum. Once the backoff ends the circuit is
+// half-open: a single call is let through, and its outcome closes or reopens the circuit.
+type Breaker struct {
+	mu          sync.Mutex
+	state       State
+	failures    int // consecutive failures
+	opens       int // consecutive openings, used for the backoff
+	openUntil   time.Time
+	probing     bool
+	threshold   int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	now         func() time.Time
+}
+
+// Status is a snapshot of the Breaker.
+type Status struct {
+	State    State
+	Failures int
+	// RetryAt is when the open circuit becomes half-open, zero unless the circuit is open.
+	RetryAt time.Time
+}
+
+func New(opts ...Option) *Breaker {
+	b := &Breaker{
+		threshold:   5,
+		baseBackoff: 30 * time.Second,
+		maxBackoff:  30 * time.Minute,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// Do calls f unless the circuit is open, in which case ErrOpen is returned.
+// The error returned by f is recorded as a failure, unless ctx was canceled,
+// because then the dependency is not to blame.
+func (b *Breaker) Do(ctx context.Context, f func() error) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = f()
+	b.record(err, ctx.Err() != nil, probe)
+
+	return err
+}
+
+// Status returns the current state of the breaker.
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+	st := Status{State: b.state, Failures: b.failures}
+	if b.state == Open {
+		st.RetryAt = b.openUntil
+	}
+
+	return st
+}
+
+// allow reports whether a call may go through, and whether it is the probe of the half-open circuit.
+func (b *Breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+	switch b.state {
+	case Open:
+		return false, ErrOpen
+	case HalfOpen:
+		if b.probing {
+			return false, ErrOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// record counts the outcome of a call allowed by allow. Only the probe decides the fate of a circuit
+// that is not closed, a call allowed before the circuit opened may finish long after that.
+func (b *Breaker) record(err error, canceled, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	} else if b.state != Closed {
+		return
+	}
+
+	switch {
+	case canceled:
+		// Neither a success nor a failure, a half-open breaker lets the next probe through.
+	case err == nil:
+		b.state = Closed
+		b.failures = 0
+		b.opens = 0
+	case probe:
+		b.failures++
+		b.open()
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+// advance moves an open circuit to half-open once the backoff ended, must be called with b.mu held.
+func (b *Breaker) advance() {
+	if b.state == Open && !b.now().Before(b.openUntil) {
+		b.state = HalfOpen
+		b.probing = false
+	}
+}
+
+// open opens the circuit for the next backoff, must be called with b.mu held.
+func (b *Breaker) open() {
+	b.state = Open
+	b.opens++
+	b.openUntil = b.now().Add(b.backoff())
+}
+
+// backoff doubles with every consecutive opening, up to maxBackoff.
+// Half of it is random, so several replicas don't retry in lockstep.
+func (b *Breaker) backoff() time.Duration {
+	d := b.baseBackoff
+	for i := 1; i < b.opens && d < b.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, b.maxBackoff)
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1)) //nolint:gosec // jitter doesn't need a secure source
+}
@@ -0,0 +1,219 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+// fakeClock only moves when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+const (
+	testBase = 10 * time.Second
+	testMax  = time.Minute
+)
+
+func newTestBreaker(clock *fakeClock) *Breaker {
+	return New(WithThreshold(3), WithBackoff(testBase, testMax), WithClock(clock.Now))
+}
+
+func fail() error { return errFailed }
+
+func succeed() error { return nil }
+
+// openBreaker fails the calls until the circuit opens.
+func openBreaker(t *testing.T, b *Breaker) {
+	t.Helper()
+	for i := 0; i < b.threshold; i++ {
+		if err := b.Do(context.Background(), fail); !errors.Is(err, errFailed) {
+			t.Fatalf("Do() = %v, want the error of the call", err)
+		}
+	}
+	if st := b.Status(); st.State != Open {
+		t.Fatalf("state = %s, want open", st.State)
+	}
+}
+
+// checkRetryAt checks that the circuit is open for a backoff of d with up to half of it as jitter.
+func checkRetryAt(t *testing.T, b *Breaker, clock *fakeClock, d time.Duration) {
+	t.Helper()
+	st := b.Status()
+	if st.State != Open {
+		t.Fatalf("state = %s, want open", st.State)
+	}
+	if wait := st.RetryAt.Sub(clock.Now()); wait < d/2 || wait > d {
+		t.Errorf("retry in %s, want between %s and %s", wait, d/2, d)
+	}
+}
+
+// startCall runs a call through the breaker and returns once it was allowed. The call only
+// returns once finish is called with its result, finish waits for Do to return and returns its error.
+func startCall(t *testing.T, b *Breaker) (finish func(error) error) {
+	t.Helper()
+
+	started := make(chan struct{})
+	result := make(chan error)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Do(context.Background(), func() error {
+			close(started)
+			return <-result
+		})
+	}()
+
+	select {
+	case <-started:
+	case err := <-done:
+		t.Fatalf("Do() = %v, want the call allowed", err)
+	}
+
+	return func(err error) error {
+		result <- err
+		return <-done
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	clock := newFakeClock()
+	b := newTestBreaker(clock)
+
+	// A success resets the consecutive failures.
+	_ = b.Do(context.Background(), fail)
+	_ = b.Do(context.Background(), fail)
+	_ = b.Do(context.Background(), succeed)
+	if st := b.Status(); st.State != Closed || st.Failures != 0 {
+		t.Fatalf("status = %+v, want closed without failures", st)
+	}
+
+	openBreaker(t, b)
+	checkRetryAt(t, b, clock, testBase)
+
+	called := false
+	err := b.Do(context.Background(), func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrOpen) || called {
+		t.Errorf("Do() = %v, called = %t, want ErrOpen without the call", err, called)
+	}
+}
+
+func TestBreakerCanceledCallsAreNotFailures(t *testing.T) {
+	b := newTestBreaker(newFakeClock())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 2*b.threshold; i++ {
+		_ = b.Do(ctx, fail)
+	}
+	if st := b.Status(); st.State != Closed || st.Failures != 0 {
+		t.Errorf("status = %+v, want closed without failures", st)
+	}
+}
+
+func TestBreakerProbeSucceeds(t *testing.T) {
+	clock := newFakeClock()
+	b := newTestBreaker(clock)
+	openBreaker(t, b)
+
+	clock.Advance(testBase)
+	if st := b.Status(); st.State != HalfOpen {
+		t.Fatalf("state after the backoff = %s, want half-open", st.State)
+	}
+
+	err := b.Do(context.Background(), func() error {
+		// Only a single probe goes through.
+		if err := b.Do(context.Background(), succeed); !errors.Is(err, ErrOpen) {
+			t.Errorf("Do() during the probe = %v, want ErrOpen", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Status(); st.State != Closed || st.Failures != 0 {
+		t.Errorf("status = %+v, want closed without failures", st)
+	}
+
+	// The next opening starts from the base backoff again.
+	openBreaker(t, b)
+	checkRetryAt(t, b, clock, testBase)
+}
+
+func TestBreakerProbeFails(t *testing.T) {
+	clock := newFakeClock()
+	b := newTestBreaker(clock)
+	openBreaker(t, b)
+
+	backoff := testBase
+	for _, want := range []time.Duration{2 * testBase, 4 * testBase, testMax, testMax} {
+		clock.Advance(backoff)
+		if err := b.Do(context.Background(), fail); !errors.Is(err, errFailed) {
+			t.Fatalf("Do() = %v, want the probe called", err)
+		}
+		checkRetryAt(t, b, clock, want)
+		backoff = want
+	}
+}
+
+func TestBreakerIgnoresStaleCalls(t *testing.T) {
+	for _, stale := range []error{nil, errFailed} {
+		t.Run(fmtErr(stale), func(t *testing.T) {
+			clock := newFakeClock()
+			b := newTestBreaker(clock)
+
+			// Allowed while closed, finishes during the probe.
+			finishStale := startCall(t, b)
+			openBreaker(t, b)
+			clock.Advance(testBase)
+			finishProbe := startCall(t, b)
+
+			if err := finishStale(stale); !errors.Is(err, stale) {
+				t.Fatalf("stale Do() = %v, want %v", err, stale)
+			}
+			if st := b.Status(); st.State != HalfOpen {
+				t.Fatalf("state after the stale call = %s, want half-open", st.State)
+			}
+			if err := b.Do(context.Background(), succeed); !errors.Is(err, ErrOpen) {
+				t.Fatalf("Do() during the probe = %v, want ErrOpen", err)
+			}
+
+			// The probe still decides, and the backoff only doubles once.
+			if err := finishProbe(errFailed); !errors.Is(err, errFailed) {
+				t.Fatalf("probe Do() = %v, want %v", err, errFailed)
+			}
+			checkRetryAt(t, b, clock, 2*testBase)
+		})
+	}
+}
+
+func fmtErr(err error) string {
+	if err == nil {
+		return "success"
+	}
+	return "failure"
+}
@@ -0,0 +1,448 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+var _ models.Store = (*AccountModel)(nil)
+
+var ErrSnapshot = errors.New("memory: failed to process the snapshot")
+
+// AccountModel is a models.Store that keeps everything in memory.
+// If it was created with a snapshot path, the state is loaded from it on start
+// and written back to it on Close.
+type AccountModel struct {
+	mu       sync.Mutex
+	accounts map[int64]models.Account
+	nextID   int64
+	tokens   map[string]models.Token
+	counters map[string]counter
+	snapshot string
+}
+
+type counter struct {
+	Count     int64     `json:"count"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewAccountModel returns an empty store, or a store restored from the snapshot file
+// if snapshotPath is not empty and the file exists.
+func NewAccountModel(snapshotPath string) (*AccountModel, error) {
+	am := &AccountModel{
+		accounts: make(map[int64]models.Account),
+		nextID:   1,
+		tokens:   make(map[string]models.Token),
+		counters: make(map[string]counter),
+		snapshot: snapshotPath,
+	}
+	if snapshotPath == "" {
+		return am, nil
+	}
+
+	if err := am.load(); err != nil {
+		return nil, err
+	}
+
+	return am, nil
+}
+
+func (am *AccountModel) Insert(_ context.Context, acc *models.Account) (id any, err error) {
+	if acc == nil {
+		return nil, models.ErrInsertFailed
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	i := am.nextID
+	am.nextID++
+
+	stored := *acc
+	stored.ID = i
+	stored.State = models.StateAvailable
+	stored.LeasedUntil = time.Time{}
+	am.accounts[i] = stored
+
+	return i, nil
+}
+
+func (am *AccountModel) Lease(_ context.Context, ttl time.Duration) (*models.Account, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for id, acc := range am.accounts {
+		if !acc.State.Servable() {
+			continue
+		}
+		acc.State = models.StateLeased
+		acc.LeasedUntil = time.Now().Add(ttl)
+		am.accounts[id] = acc
+		return &acc, nil
+	}
+
+	return nil, models.ErrNoRecord
+}
+
+func (am *AccountModel) Confirm(_ context.Context, id any) error {
+	i, err := toInt64(id)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	acc, ok := am.accounts[i]
+	if !ok || acc.State != models.StateLeased {
+		return models.ErrNoRecord
+	}
+	acc.State = models.StateDelivered
+	acc.LeasedUntil = time.Time{}
+	acc.DeliveredAt = time.Now()
+	am.accounts[i] = acc
+
+	return nil
+}
+
+func (am *AccountModel) Release(_ context.Context, id any) error {
+	return am.transition(id, models.StateLeased, models.StateAvailable)
+}
+
+func (am *AccountModel) ExpireLeases(_ context.Context, now time.Time) (int64, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var n int64
+	for id, acc := range am.accounts {
+		if acc.State == models.StateLeased && acc.LeasedUntil.Before(now) {
+			acc.State = models.StateExpired
+			acc.LeasedUntil = time.Time{}
+			am.accounts[id] = acc
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (am *AccountModel) PurgeDelivered(_ context.Context, before time.Time) (int64, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var n int64
+	for id, acc := range am.accounts {
+		if acc.State == models.StateDelivered && acc.DeliveredAt.Before(before) {
+			delete(am.accounts, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// transition moves the account with the given id from one state to another.
+func (am *AccountModel) transition(id any, from, to models.State) error {
+	i, err := toInt64(id)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	acc, ok := am.accounts[i]
+	if !ok || acc.State != from {
+		return models.ErrNoRecord
+	}
+	acc.State = to
+	acc.LeasedUntil = time.Time{}
+	am.accounts[i] = acc
+
+	return nil
+}
+
+func (am *AccountModel) Len(_ context.Context) int64 {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var n int64
+	for _, acc := range am.accounts {
+		if acc.State.Servable() {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (am *AccountModel) InsertToken(_ context.Context, t *models.Token) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, ok := am.tokens[t.ID]; ok {
+		return models.ErrInsertFailed
+	}
+	for id := range am.tokens {
+		if am.tokens[id].Hash == t.Hash {
+			return models.ErrInsertFailed
+		}
+	}
+	am.tokens[t.ID] = *t
+
+	return nil
+}
+
+func (am *AccountModel) GetTokenByHash(_ context.Context, hash string) (*models.Token, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for _, t := range am.tokens {
+		if t.Hash == hash {
+			t := t
+			return &t, nil
+		}
+	}
+
+	return nil, models.ErrNoRecord
+}
+
+func (am *AccountModel) ListTokens(_ context.Context) ([]models.Token, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	tokens := make([]models.Token, 0, len(am.tokens))
+	for _, t := range am.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+func (am *AccountModel) RevokeToken(_ context.Context, id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	t, ok := am.tokens[id]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	t.RevokedAt = time.Now()
+	am.tokens[id] = t
+
+	return nil
+}
+
+func (am *AccountModel) IncrCounter(_ context.Context, key string, expiresAt time.Time) (int64, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	now := time.Now()
+	c, ok := am.counters[key]
+	if !ok || c.ExpiresAt.Before(now) {
+		// Drop the expired counters while we are here, so the map doesn't grow forever.
+		for k, c := range am.counters {
+			if c.ExpiresAt.Before(now) {
+				delete(am.counters, k)
+			}
+		}
+		c = counter{ExpiresAt: expiresAt}
+	}
+	c.Count++
+	am.counters[key] = c
+
+	return c.Count, nil
+}
+
+func (am *AccountModel) DecrCounter(_ context.Context, key string) (int64, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	c, ok := am.counters[key]
+	if !ok || c.ExpiresAt.Before(time.Now()) || c.Count <= 0 {
+		return 0, nil
+	}
+	c.Count--
+	am.counters[key] = c
+
+	return c.Count, nil
+}
+
+func (am *AccountModel) Counter(_ context.Context, key string) (int64, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	c, ok := am.counters[key]
+	if !ok || c.ExpiresAt.Before(time.Now()) {
+		return 0, nil
+	}
+
+	return c.Count, nil
+}
+
+// Ping always succeeds, the store is in the process.
+func (am *AccountModel) Ping(_ context.Context) error {
+	return nil
+}
+
+// Close writes the snapshot to disk, if the store was created with a snapshot path.
+func (am *AccountModel) Close(_ context.Context) error {
+	if am.snapshot == "" {
+		return nil
+	}
+
+	return am.save()
+}
+
+// snapshotData is the on-disk representation of the store.
+type snapshotData struct {
+	NextID   int64              `json:"next_id"`
+	Accounts []snapshotAccount  `json:"accounts"`
+	Tokens   []snapshotToken    `json:"tokens,omitempty"`
+	Counters map[string]counter `json:"counters,omitempty"`
+}
+
+// snapshotToken is models.Token with the hash included, models.Token doesn't serialize it.
+type snapshotToken struct {
+	models.Token
+	Hash string `json:"hash"`
+}
+
+type snapshotAccount struct {
+	ID          int64        `json:"id"`
+	Type        string       `json:"account_type"`
+	RefCount    json.Number  `json:"referral_count"`
+	License     string       `json:"license"`
+	State       models.State `json:"state,omitempty"`
+	LeasedUntil time.Time    `json:"leased_until,omitempty"`
+	DeliveredAt time.Time    `json:"delivered_at,omitempty"`
+}
+
+func (am *AccountModel) load() error {
+	b, err := os.ReadFile(am.snapshot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+
+	var data snapshotData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for _, a := range data.Accounts {
+		am.accounts[a.ID] = models.Account{
+			ID:          a.ID,
+			Type:        a.Type,
+			RefCount:    a.RefCount,
+			License:     a.License,
+			State:       a.State,
+			LeasedUntil: a.LeasedUntil,
+			DeliveredAt: a.DeliveredAt,
+		}
+		if a.ID >= am.nextID {
+			am.nextID = a.ID + 1
+		}
+	}
+	if data.NextID > am.nextID {
+		am.nextID = data.NextID
+	}
+	for _, t := range data.Tokens {
+		t.Token.Hash = t.Hash
+		am.tokens[t.ID] = t.Token
+	}
+	for k, c := range data.Counters {
+		am.counters[k] = c
+	}
+
+	return nil
+}
+
+func (am *AccountModel) save() error {
+	am.mu.Lock()
+	data := snapshotData{
+		NextID:   am.nextID,
+		Accounts: make([]snapshotAccount, 0, len(am.accounts)),
+		Tokens:   make([]snapshotToken, 0, len(am.tokens)),
+		Counters: make(map[string]counter, len(am.counters)),
+	}
+	for _, t := range am.tokens {
+		data.Tokens = append(data.Tokens, snapshotToken{Token: t, Hash: t.Hash})
+	}
+	for k, c := range am.counters {
+		data.Counters[k] = c
+	}
+	for id, a := range am.accounts {
+		data.Accounts = append(data.Accounts, snapshotAccount{
+			ID:          id,
+			Type:        a.Type,
+			RefCount:    a.RefCount,
+			License:     a.License,
+			State:       a.State,
+			LeasedUntil: a.LeasedUntil,
+			DeliveredAt: a.DeliveredAt,
+		})
+	}
+	am.mu.Unlock()
+
+	b, err := json.MarshalIndent(&data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+
+	// Write to a temporary file first, so a crash never leaves a half-written snapshot behind.
+	tmp, err := os.CreateTemp(filepath.Dir(am.snapshot), filepath.Base(am.snapshot)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+	if err := os.Rename(tmp.Name(), am.snapshot); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+
+	return nil
+}
+
+// toInt64 converts the id returned by Insert/Lease (or its textual form) to the map key.
+func toInt64(id any) (int64, error) {
+	switch v := id.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, models.ErrInvalidKey
+		}
+		return i, nil
+	default:
+		return 0, models.ErrInvalidKey
+	}
+}
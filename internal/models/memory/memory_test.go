@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/handsomefox/gowarp/internal/models/modelstest"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	am, err := NewAccountModel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, license := range []string{"a", "b", "c", "d"} {
+		if _, err := am.Insert(ctx, &models.Account{Type: "limited", RefCount: "1", License: license}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last id is gone, the next one must not be reused.
+	delete(am.accounts, am.nextID-1)
+
+	delivered, err := am.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := am.Confirm(ctx, delivered.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := am.Lease(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := []models.Token{
+		{ID: "1", Name: "alice", Hash: "hash1", DailyQuota: 10, CreatedAt: time.Now()},
+		{ID: "2", Name: "bob", Hash: "hash2", CreatedAt: time.Now()},
+	}
+	for i := range tokens {
+		if err := am.InsertToken(ctx, &tokens[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := am.RevokeToken(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	if _, err := am.IncrCounter(ctx, "counter", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := am.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewAccountModel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.nextID != am.nextID {
+		t.Errorf("nextID = %d, want %d", restored.nextID, am.nextID)
+	}
+
+	if len(restored.accounts) != len(am.accounts) {
+		t.Fatalf("restored %d accounts, want %d", len(restored.accounts), len(am.accounts))
+	}
+	states := make(map[models.State]int)
+	for id, want := range am.accounts {
+		got, ok := restored.accounts[id]
+		if !ok {
+			t.Errorf("account %d is missing", id)
+			continue
+		}
+		states[got.State]++
+		if got.ID != want.ID || got.Type != want.Type || got.RefCount != want.RefCount ||
+			got.License != want.License || got.State != want.State ||
+			!got.LeasedUntil.Equal(want.LeasedUntil) || !got.DeliveredAt.Equal(want.DeliveredAt) {
+			t.Errorf("account %d = %+v, want %+v", id, got, want)
+		}
+	}
+	if states[models.StateAvailable] != 1 || states[models.StateLeased] != 1 || states[models.StateDelivered] != 1 {
+		t.Errorf("restored states = %v, want one of each", states)
+	}
+
+	for _, want := range am.tokens {
+		got, err := restored.GetTokenByHash(ctx, want.Hash)
+		if err != nil {
+			t.Errorf("token %s: %v", want.ID, err)
+			continue
+		}
+		if got.ID != want.ID || got.Name != want.Name || got.DailyQuota != want.DailyQuota ||
+			!got.CreatedAt.Equal(want.CreatedAt) || !got.RevokedAt.Equal(want.RevokedAt) {
+			t.Errorf("token = %+v, want %+v", got, want)
+		}
+	}
+
+	c, ok := restored.counters["counter"]
+	if !ok || c.Count != 1 || !c.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("counter = %+v, want 1 expiring at %s", c, expiresAt)
+	}
+
+	// The restored store keeps working: the leased key can be confirmed, the delivered one purged.
+	for id, acc := range restored.accounts {
+		if acc.State == models.StateLeased {
+			if err := restored.Confirm(ctx, id); err != nil {
+				t.Errorf("Confirm() of the restored lease = %v", err)
+			}
+		}
+	}
+	if n, err := restored.PurgeDelivered(ctx, time.Now().Add(time.Second)); err != nil || n != 2 {
+		t.Errorf("PurgeDelivered() = %d, %v, want 2", n, err)
+	}
+}
+
+func TestSnapshotMissing(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	am, err := NewAccountModel(path)
+	if err != nil {
+		t.Fatalf("NewAccountModel() with a missing snapshot = %v, want an empty store", err)
+	}
+	if n := am.Len(ctx); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+
+	if err := am.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the snapshot was not written on Close: %v", err)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, []byte(`{"next_id": 3, "accounts": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAccountModel(path); !errors.Is(err, ErrSnapshot) {
+		t.Errorf("NewAccountModel() with a corrupt snapshot = %v, want ErrSnapshot", err)
+	}
+}
+
+func TestConcurrentLease(t *testing.T) {
+	am, err := NewAccountModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modelstest.TestConcurrentLease(t, am)
+}
@@ -1,15 +1,114 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"time"
 )
 
 type Account struct {
-	ID       any         `bson:"_id,omitempty"  json:"id,omitempty"`
-	Type     string      `bson:"account_type"   json:"account_type"`
-	RefCount json.Number `bson:"referral_count" json:"referral_count"`
-	License  string      `bson:"license"        json:"license"`
+	ID          any         `bson:"_id,omitempty"          json:"id,omitempty"`
+	Type        string      `bson:"account_type"           json:"account_type"`
+	RefCount    json.Number `bson:"referral_count"         json:"referral_count"`
+	License     string      `bson:"license"                json:"license"`
+	State       State       `bson:"state,omitempty"        json:"state,omitempty"`
+	LeasedUntil time.Time   `bson:"leased_until,omitempty" json:"-"`
+	DeliveredAt time.Time   `bson:"delivered_at,omitempty" json:"-"`
+}
+
+// State is the lifecycle state of a pooled account.
+//
+// A key starts as available, gets leased when it is handed out and becomes
+// delivered once the handout is confirmed. The delivered keys are kept for a while,
+// until they are purged. If the lease times out before the confirmation,
+// the key becomes expired, which puts it back into the pool.
+type State string
+
+const (
+	StateAvailable State = "available"
+	StateLeased    State = "leased"
+	StateDelivered State = "delivered"
+	StateExpired   State = "expired"
+)
+
+// Servable reports whether an account in this state can be handed out.
+// Accounts stored before states were introduced have an empty state and are servable as well.
+func (s State) Servable() bool {
+	return s == "" || s == StateAvailable || s == StateExpired
+}
+
+// AccountStore is the storage used by the server to keep the pool of generated accounts.
+type AccountStore interface {
+	// Insert stores the account as available and returns its id.
+	Insert(ctx context.Context, acc *Account) (id any, err error)
+	// Lease atomically marks any servable account as leased until now+ttl and returns it,
+	// or ErrNoRecord if there are none. Concurrent callers never receive the same account.
+	Lease(ctx context.Context, ttl time.Duration) (*Account, error)
+	// Confirm marks the leased account with the given id as delivered now.
+	// It returns ErrNoRecord if the account is not leased anymore.
+	Confirm(ctx context.Context, id any) error
+	// Release puts the leased account with the given id back into the pool.
+	Release(ctx context.Context, id any) error
+	// ExpireLeases marks every account whose lease ended before now as expired
+	// and returns the amount of affected accounts.
+	ExpireLeases(ctx context.Context, now time.Time) (int64, error)
+	// PurgeDelivered removes the accounts delivered before the given time
+	// and returns the amount of removed accounts.
+	PurgeDelivered(ctx context.Context, before time.Time) (int64, error)
+	// Len returns the amount of servable accounts.
+	Len(ctx context.Context) int64
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the resources held by the store.
+	Close(ctx context.Context) error
+}
+
+// Token is an API token used to authenticate the users of the server.
+// Only the hash of the token is stored.
+type Token struct {
+	ID         string    `bson:"_id"                  json:"id"`
+	Name       string    `bson:"name"                 json:"name"`
+	Hash       string    `bson:"hash"                 json:"-"`
+	DailyQuota int64     `bson:"daily_quota"          json:"daily_quota"`
+	CreatedAt  time.Time `bson:"created_at"           json:"created_at"`
+	RevokedAt  time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the token was revoked.
+func (t *Token) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// TokenStore is the storage of the API tokens.
+type TokenStore interface {
+	// InsertToken stores the token.
+	InsertToken(ctx context.Context, t *Token) error
+	// GetTokenByHash returns the token with the given hash, or ErrNoRecord if there is none.
+	GetTokenByHash(ctx context.Context, hash string) (*Token, error)
+	// ListTokens returns every stored token, including the revoked ones.
+	ListTokens(ctx context.Context) ([]Token, error)
+	// RevokeToken marks the token with the given id as revoked, or returns ErrNoRecord if there is none.
+	RevokeToken(ctx context.Context, id string) error
+}
+
+// CounterStore keeps named counters that expire, e.g. the usage of a token per day.
+type CounterStore interface {
+	// IncrCounter increments the counter and returns its new value.
+	// The expiresAt is only used when the counter is created, an expired counter starts over.
+	IncrCounter(ctx context.Context, key string, expiresAt time.Time) (int64, error)
+	// DecrCounter decrements the counter and returns its new value. A counter that doesn't exist,
+	// has expired or is already 0 is left as it is and 0 is returned.
+	DecrCounter(ctx context.Context, key string) (int64, error)
+	// Counter returns the current value of the counter, or 0 if it doesn't exist or has expired.
+	Counter(ctx context.Context, key string) (int64, error)
+}
+
+// Store is implemented by every storage backend.
+type Store interface {
+	AccountStore
+	TokenStore
+	CounterStore
 }
 
 var (
@@ -19,4 +118,5 @@ var (
 	ErrConnectionFailed = errors.New("models: couldn't connect to database")
 	ErrPingFailed       = errors.New("models: couldn't ping database")
 	ErrInsertFailed     = errors.New("models: couldn't insert an entry to the database")
+	ErrUpdateFailed     = errors.New("models: couldn't update an entry in the database")
 )
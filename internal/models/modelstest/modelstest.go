@@ -0,0 +1,73 @@
+// Package modelstest provides the tests shared by the models.AccountStore implementations.
+package modelstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+)
+
+// TestConcurrentLease fills the empty store with accounts and leases them from many goroutines
+// at once. It fails if an account is handed out twice, or if the pool is not drained.
+func TestConcurrentLease(t *testing.T, store models.AccountStore) {
+	t.Helper()
+
+	const (
+		accounts   = 100
+		goroutines = 16
+	)
+	ctx := context.Background()
+
+	for i := 0; i < accounts; i++ {
+		acc := &models.Account{Type: "limited", RefCount: "1", License: fmt.Sprintf("license-%d", i)}
+		if _, err := store.Insert(ctx, acc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		leased = make(map[string]bool)
+		wg     sync.WaitGroup
+		start  = make(chan struct{})
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for {
+				acc, err := store.Lease(ctx, time.Minute)
+				if errors.Is(err, models.ErrNoRecord) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				id := fmt.Sprint(acc.ID)
+				mu.Lock()
+				if leased[id] {
+					t.Errorf("account %s was leased twice", id)
+				}
+				leased[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if len(leased) != accounts {
+		t.Errorf("leased %d accounts, want %d", len(leased), accounts)
+	}
+	if n := store.Len(ctx); n != 0 {
+		t.Errorf("Len() = %d after leasing everything, want 0", n)
+	}
+}
@@ -2,16 +2,25 @@ package mongo
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/handsomefox/gowarp/internal/models"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var _ models.Store = (*AccountModel)(nil)
+
+// AccountModel is a models.Store backed by MongoDB.
+// The accounts are kept in the given collection, the tokens and counters
+// in the collections with the "_tokens" and "_counters" suffixes.
 type AccountModel struct {
+	client     *mongo.Client
 	collection *mongo.Collection
+	tokens     *mongo.Collection
+	counters   *mongo.Collection
 }
 
 func NewAccountModel(ctx context.Context, uri, database, collection string) (*AccountModel, error) {
@@ -25,13 +34,44 @@ func NewAccountModel(ctx context.Context, uri, database, collection string) (*Ac
 	if err != nil {
 		return nil, models.ErrPingFailed
 	}
-	coll := client.Database(database).Collection(collection)
+	db := client.Database(database)
+	am := &AccountModel{
+		client:     client,
+		collection: db.Collection(collection),
+		tokens:     db.Collection(collection + "_tokens"),
+		counters:   db.Collection(collection + "_counters"),
+	}
+
+	if _, err := am.tokens.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, models.ErrConnectionFailed
+	}
+	// Let MongoDB remove the expired counters.
+	if _, err := am.counters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}); err != nil {
+		return nil, models.ErrConnectionFailed
+	}
 
-	return &AccountModel{collection: coll}, nil
+	return am, nil
 }
 
+// servableFilter matches the accounts that can be handed out,
+// including the ones stored before the state field was introduced.
+var servableFilter = bson.D{{Key: "$or", Value: bson.A{
+	bson.D{{Key: "state", Value: bson.D{{Key: "$in", Value: bson.A{models.StateAvailable, models.StateExpired}}}}},
+	bson.D{{Key: "state", Value: bson.D{{Key: "$exists", Value: false}}}},
+}}}
+
 func (am *AccountModel) Insert(ctx context.Context, acc *models.Account) (id any, err error) {
-	res, err := am.collection.InsertOne(ctx, acc)
+	stored := *acc
+	stored.State = models.StateAvailable
+	stored.LeasedUntil = time.Time{}
+
+	res, err := am.collection.InsertOne(ctx, &stored)
 	if err != nil {
 		return nil, models.ErrInsertFailed
 	}
@@ -39,9 +79,15 @@ func (am *AccountModel) Insert(ctx context.Context, acc *models.Account) (id any
 	return res.InsertedID, nil
 }
 
-func (am *AccountModel) GetAny(ctx context.Context) (*models.Account, error) {
+func (am *AccountModel) Lease(ctx context.Context, ttl time.Duration) (*models.Account, error) {
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "state", Value: models.StateLeased},
+		{Key: "leased_until", Value: time.Now().Add(ttl)},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
 	acc := &models.Account{}
-	res := am.collection.FindOne(ctx, bson.D{{}})
+	res := am.collection.FindOneAndUpdate(ctx, servableFilter, update, opts)
 	if err := res.Decode(acc); err != nil {
 		return nil, models.ErrNoRecord
 	}
@@ -49,20 +95,220 @@ func (am *AccountModel) GetAny(ctx context.Context) (*models.Account, error) {
 	return acc, nil
 }
 
-func (am *AccountModel) Delete(ctx context.Context, id any) error {
-	_, err := am.collection.DeleteOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}})
+func (am *AccountModel) Confirm(ctx context.Context, id any) error {
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "state", Value: models.StateLeased},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "state", Value: models.StateDelivered},
+			{Key: "delivered_at", Value: time.Now()},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "leased_until", Value: ""}}},
+	}
+
+	res, err := am.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if res.MatchedCount == 0 {
+		return models.ErrNoRecord
+	}
+
+	return nil
+}
+
+func (am *AccountModel) Release(ctx context.Context, id any) error {
+	return am.transition(ctx, id, models.StateLeased, models.StateAvailable)
+}
+
+func (am *AccountModel) ExpireLeases(ctx context.Context, now time.Time) (int64, error) {
+	filter := bson.D{
+		{Key: "state", Value: models.StateLeased},
+		{Key: "leased_until", Value: bson.D{{Key: "$lt", Value: now}}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "state", Value: models.StateExpired}}},
+		{Key: "$unset", Value: bson.D{{Key: "leased_until", Value: ""}}},
+	}
+
+	res, err := am.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, models.ErrUpdateFailed
+	}
+
+	return res.ModifiedCount, nil
+}
+
+func (am *AccountModel) PurgeDelivered(ctx context.Context, before time.Time) (int64, error) {
+	filter := bson.D{
+		{Key: "state", Value: models.StateDelivered},
+		{Key: "delivered_at", Value: bson.D{{Key: "$lt", Value: before}}},
+	}
+
+	res, err := am.collection.DeleteMany(ctx, filter)
 	if err != nil {
-		return models.ErrDeleteFailed
+		return 0, models.ErrDeleteFailed
+	}
+
+	return res.DeletedCount, nil
+}
+
+// transition moves the account with the given id from one state to another.
+func (am *AccountModel) transition(ctx context.Context, id any, from, to models.State) error {
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "state", Value: from},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "state", Value: to}}},
+		{Key: "$unset", Value: bson.D{{Key: "leased_until", Value: ""}}},
+	}
+
+	res, err := am.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if res.MatchedCount == 0 {
+		return models.ErrNoRecord
 	}
 
 	return nil
 }
 
 func (am *AccountModel) Len(ctx context.Context) int64 {
-	i, err := am.collection.CountDocuments(ctx, bson.D{{}})
+	i, err := am.collection.CountDocuments(ctx, servableFilter)
 	if err != nil {
 		return 0
 	}
 
 	return i
 }
+
+func (am *AccountModel) InsertToken(ctx context.Context, t *models.Token) error {
+	if _, err := am.tokens.InsertOne(ctx, t); err != nil {
+		return models.ErrInsertFailed
+	}
+
+	return nil
+}
+
+func (am *AccountModel) GetTokenByHash(ctx context.Context, hash string) (*models.Token, error) {
+	t := &models.Token{}
+	res := am.tokens.FindOne(ctx, bson.D{{Key: "hash", Value: hash}})
+	if err := res.Decode(t); err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	return t, nil
+}
+
+func (am *AccountModel) ListTokens(ctx context.Context) ([]models.Token, error) {
+	cur, err := am.tokens.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	var tokens []models.Token
+	if err := cur.All(ctx, &tokens); err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	return tokens, nil
+}
+
+func (am *AccountModel) RevokeToken(ctx context.Context, id string) error {
+	res, err := am.tokens.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}},
+	)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if res.MatchedCount == 0 {
+		return models.ErrNoRecord
+	}
+
+	return nil
+}
+
+func (am *AccountModel) IncrCounter(ctx context.Context, key string, expiresAt time.Time) (int64, error) {
+	now := time.Now()
+	// The TTL monitor only runs once a minute, so an expired counter may still exist.
+	// A missing expires_at compares as less than any date, which also covers a new counter.
+	expired := bson.D{{Key: "$lt", Value: bson.A{"$expires_at", now}}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+		{Key: "count", Value: bson.D{{Key: "$cond", Value: bson.A{
+			expired, 1, bson.D{{Key: "$add", Value: bson.A{"$count", 1}}},
+		}}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$cond", Value: bson.A{
+			expired, expiresAt, "$expires_at",
+		}}}},
+	}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	res := am.counters.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, update, opts)
+	if err := res.Decode(&counter); err != nil {
+		return 0, models.ErrUpdateFailed
+	}
+
+	return counter.Count, nil
+}
+
+func (am *AccountModel) DecrCounter(ctx context.Context, key string) (int64, error) {
+	filter := bson.D{
+		{Key: "_id", Value: key},
+		{Key: "expires_at", Value: bson.D{{Key: "$gte", Value: time.Now()}}},
+		{Key: "count", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: -1}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	res := am.counters.FindOneAndUpdate(ctx, filter, update, opts)
+	if err := res.Decode(&counter); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, models.ErrUpdateFailed
+	}
+
+	return counter.Count, nil
+}
+
+func (am *AccountModel) Counter(ctx context.Context, key string) (int64, error) {
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	res := am.counters.FindOne(ctx, bson.D{
+		{Key: "_id", Value: key},
+		{Key: "expires_at", Value: bson.D{{Key: "$gte", Value: time.Now()}}},
+	})
+	if err := res.Decode(&counter); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, models.ErrNoRecord
+	}
+
+	return counter.Count, nil
+}
+
+func (am *AccountModel) Ping(ctx context.Context) error {
+	if err := am.client.Ping(ctx, nil); err != nil {
+		return models.ErrPingFailed
+	}
+
+	return nil
+}
+
+// Close disconnects from the database.
+func (am *AccountModel) Close(ctx context.Context) error {
+	return am.client.Disconnect(ctx)
+}
@@ -0,0 +1,442 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+var _ models.Store = (*AccountModel)(nil)
+
+// AccountModel is a models.Store backed by an embedded SQLite database.
+type AccountModel struct {
+	db *sql.DB
+}
+
+// NewAccountModel opens (or creates) the database at path and applies the pending migrations.
+func NewAccountModel(ctx context.Context, path string) (*AccountModel, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, models.ErrConnectionFailed
+	}
+	// SQLite only supports a single writer, serialize everything through one connection.
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, models.ErrPingFailed
+	}
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &AccountModel{db: db}, nil
+}
+
+// accountColumns are the columns read by scanAccount, in order.
+const accountColumns = `id, account_type, referral_count, license, state, leased_until`
+
+// servableStates is the SQL condition matching the accounts that can be handed out.
+const servableStates = `state IN ('available', 'expired')`
+
+func (am *AccountModel) Insert(ctx context.Context, acc *models.Account) (id any, err error) {
+	res, err := am.db.ExecContext(ctx,
+		`INSERT INTO accounts (account_type, referral_count, license, state) VALUES (?, ?, ?, ?)`,
+		acc.Type, acc.RefCount.String(), acc.License, models.StateAvailable)
+	if err != nil {
+		return nil, models.ErrInsertFailed
+	}
+
+	i, err := res.LastInsertId()
+	if err != nil {
+		return nil, models.ErrInsertFailed
+	}
+
+	return i, nil
+}
+
+func (am *AccountModel) Lease(ctx context.Context, ttl time.Duration) (*models.Account, error) {
+	// A single UPDATE ... RETURNING statement is atomic, so the row can only be leased once.
+	row := am.db.QueryRowContext(ctx, `UPDATE accounts SET state = ?, leased_until = ?
+		WHERE id = (SELECT id FROM accounts WHERE `+servableStates+` LIMIT 1)
+		RETURNING `+accountColumns,
+		models.StateLeased, time.Now().Add(ttl).UnixNano())
+	acc, err := scanAccount(row)
+	if err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	return acc, nil
+}
+
+func (am *AccountModel) Confirm(ctx context.Context, id any) error {
+	i, err := toInt64(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := am.db.ExecContext(ctx,
+		`UPDATE accounts SET state = ?, leased_until = 0, delivered_at = ? WHERE id = ? AND state = ?`,
+		models.StateDelivered, time.Now().UnixNano(), i, models.StateLeased)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+
+	return nil
+}
+
+func (am *AccountModel) Release(ctx context.Context, id any) error {
+	return am.transition(ctx, id, models.StateLeased, models.StateAvailable)
+}
+
+func (am *AccountModel) ExpireLeases(ctx context.Context, now time.Time) (int64, error) {
+	res, err := am.db.ExecContext(ctx,
+		`UPDATE accounts SET state = ?, leased_until = 0 WHERE state = ? AND leased_until < ?`,
+		models.StateExpired, models.StateLeased, now.UnixNano())
+	if err != nil {
+		return 0, models.ErrUpdateFailed
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, models.ErrUpdateFailed
+	}
+
+	return n, nil
+}
+
+func (am *AccountModel) PurgeDelivered(ctx context.Context, before time.Time) (int64, error) {
+	res, err := am.db.ExecContext(ctx,
+		`DELETE FROM accounts WHERE state = ? AND delivered_at < ?`, models.StateDelivered, before.UnixNano())
+	if err != nil {
+		return 0, models.ErrDeleteFailed
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, models.ErrDeleteFailed
+	}
+
+	return n, nil
+}
+
+// transition moves the account with the given id from one state to another.
+func (am *AccountModel) transition(ctx context.Context, id any, from, to models.State) error {
+	i, err := toInt64(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := am.db.ExecContext(ctx,
+		`UPDATE accounts SET state = ?, leased_until = 0 WHERE id = ? AND state = ?`, to, i, from)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+
+	return nil
+}
+
+func (am *AccountModel) Len(ctx context.Context) int64 {
+	var i int64
+	if err := am.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM accounts WHERE `+servableStates).Scan(&i); err != nil {
+		return 0
+	}
+
+	return i
+}
+
+func scanAccount(row *sql.Row) (*models.Account, error) {
+	var (
+		acc         models.Account
+		id          int64
+		rc          string
+		state       string
+		leasedUntil int64
+	)
+	if err := row.Scan(&id, &acc.Type, &rc, &acc.License, &state, &leasedUntil); err != nil {
+		return nil, err
+	}
+	acc.ID = id
+	acc.RefCount = json.Number(rc)
+	acc.State = models.State(state)
+	if leasedUntil != 0 {
+		acc.LeasedUntil = time.Unix(0, leasedUntil)
+	}
+
+	return &acc, nil
+}
+
+func (am *AccountModel) InsertToken(ctx context.Context, t *models.Token) error {
+	_, err := am.db.ExecContext(ctx,
+		`INSERT INTO tokens (id, name, hash, daily_quota, created_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, t.Hash, t.DailyQuota, t.CreatedAt.UnixNano(), unixNano(t.RevokedAt))
+	if err != nil {
+		return models.ErrInsertFailed
+	}
+
+	return nil
+}
+
+func (am *AccountModel) GetTokenByHash(ctx context.Context, hash string) (*models.Token, error) {
+	row := am.db.QueryRowContext(ctx,
+		`SELECT id, name, hash, daily_quota, created_at, revoked_at FROM tokens WHERE hash = ?`, hash)
+	t, err := scanToken(row)
+	if err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	return t, nil
+}
+
+func (am *AccountModel) ListTokens(ctx context.Context) ([]models.Token, error) {
+	rows, err := am.db.QueryContext(ctx,
+		`SELECT id, name, hash, daily_quota, created_at, revoked_at FROM tokens ORDER BY created_at`)
+	if err != nil {
+		return nil, models.ErrNoRecord
+	}
+	defer rows.Close()
+
+	var tokens []models.Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, models.ErrNoRecord
+		}
+		tokens = append(tokens, *t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, models.ErrNoRecord
+	}
+
+	return tokens, nil
+}
+
+func (am *AccountModel) RevokeToken(ctx context.Context, id string) error {
+	res, err := am.db.ExecContext(ctx, `UPDATE tokens SET revoked_at = ? WHERE id = ?`, time.Now().UnixNano(), id)
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return models.ErrUpdateFailed
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+
+	return nil
+}
+
+func (am *AccountModel) IncrCounter(ctx context.Context, key string, expiresAt time.Time) (int64, error) {
+	now := time.Now().UnixNano()
+	row := am.db.QueryRowContext(ctx, `INSERT INTO counters (key, count, expires_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count      = CASE WHEN expires_at < ? THEN 1 ELSE count + 1 END,
+			expires_at = CASE WHEN expires_at < ? THEN excluded.expires_at ELSE expires_at END
+		RETURNING count`,
+		key, expiresAt.UnixNano(), now, now)
+
+	var count int64
+	if err := row.Scan(&count); err != nil {
+		return 0, models.ErrUpdateFailed
+	}
+
+	// Opportunistically drop the expired counters, so the table doesn't grow forever.
+	if count == 1 {
+		if _, err := am.db.ExecContext(ctx, `DELETE FROM counters WHERE expires_at < ?`, now); err != nil {
+			return count, nil
+		}
+	}
+
+	return count, nil
+}
+
+func (am *AccountModel) DecrCounter(ctx context.Context, key string) (int64, error) {
+	var count int64
+	row := am.db.QueryRowContext(ctx,
+		`UPDATE counters SET count = count - 1 WHERE key = ? AND expires_at >= ? AND count > 0 RETURNING count`,
+		key, time.Now().UnixNano())
+	if err := row.Scan(&count); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, models.ErrUpdateFailed
+	}
+
+	return count, nil
+}
+
+func (am *AccountModel) Counter(ctx context.Context, key string) (int64, error) {
+	var count int64
+	row := am.db.QueryRowContext(ctx,
+		`SELECT count FROM counters WHERE key = ? AND expires_at >= ?`, key, time.Now().UnixNano())
+	if err := row.Scan(&count); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, models.ErrNoRecord
+	}
+
+	return count, nil
+}
+
+func (am *AccountModel) Ping(ctx context.Context) error {
+	if err := am.db.PingContext(ctx); err != nil {
+		return models.ErrPingFailed
+	}
+
+	return nil
+}
+
+// Close closes the database.
+func (am *AccountModel) Close(_ context.Context) error {
+	return am.db.Close()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (*models.Token, error) {
+	var (
+		t                    models.Token
+		createdAt, revokedAt int64
+	)
+	if err := row.Scan(&t.ID, &t.Name, &t.Hash, &t.DailyQuota, &createdAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = time.Unix(0, createdAt)
+	if revokedAt != 0 {
+		t.RevokedAt = time.Unix(0, revokedAt)
+	}
+
+	return &t, nil
+}
+
+// unixNano is like t.UnixNano(), but returns 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// toInt64 converts the id returned by Insert/Lease (or its textual form) to the row id.
+func toInt64(id any) (int64, error) {
+	switch v := id.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, models.ErrInvalidKey
+		}
+		return i, nil
+	default:
+		return 0, models.ErrInvalidKey
+	}
+}
+
+// migrations is the ordered list of schema changes, the database's user_version
+// stores how many of them were already applied.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS accounts (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_type   TEXT    NOT NULL,
+		referral_count TEXT    NOT NULL,
+		license        TEXT    NOT NULL
+	)`,
+	`ALTER TABLE accounts ADD COLUMN state TEXT NOT NULL DEFAULT 'available'`,
+	`ALTER TABLE accounts ADD COLUMN leased_until INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS accounts_state ON accounts (state, leased_until)`,
+	`CREATE TABLE IF NOT EXISTS tokens (
+		id          TEXT    PRIMARY KEY,
+		name        TEXT    NOT NULL,
+		hash        TEXT    NOT NULL UNIQUE,
+		daily_quota INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL,
+		revoked_at  INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS counters (
+		key        TEXT    PRIMARY KEY,
+		count      INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	`ALTER TABLE accounts ADD COLUMN delivered_at INTEGER NOT NULL DEFAULT 0`,
+}
+
+var errMigrationFailed = errors.New("sqlite: failed to migrate the database")
+
+// migrate applies the pending migrations one by one. Every migration runs in its own
+// immediate transaction that also checks the version, so several processes starting
+// at once don't apply the same migration twice.
+func migrate(ctx context.Context, db *sql.DB) error {
+	for {
+		done, err := migrateOnce(ctx, db)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errMigrationFailed, err)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func migrateOnce(ctx context.Context, db *sql.DB) (done bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return false, err
+	}
+	if version >= len(migrations) {
+		return true, tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+		return false, fmt.Errorf("migration %d: %w", version+1, err)
+	}
+	// PRAGMA does not support placeholders.
+	if _, err := tx.ExecContext(ctx, "PRAGMA user_version = "+strconv.Itoa(version+1)); err != nil {
+		return false, fmt.Errorf("migration %d: %w", version+1, err)
+	}
+
+	return false, tx.Commit()
+}
@@ -0,0 +1,326 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/handsomefox/gowarp/internal/models"
+	"github.com/handsomefox/gowarp/internal/models/modelstest"
+)
+
+func openTest(t *testing.T, path string) *AccountModel {
+	t.Helper()
+	am, err := NewAccountModel(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { am.Close(context.Background()) })
+	return am
+}
+
+func newTestModel(t *testing.T) *AccountModel {
+	t.Helper()
+	return openTest(t, filepath.Join(t.TempDir(), "gowarp.db"))
+}
+
+func userVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func insert(t *testing.T, am *AccountModel, license string) any {
+	t.Helper()
+	id, err := am.Insert(context.Background(), &models.Account{Type: "limited", RefCount: "1", License: license})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gowarp.db")
+
+	am := openTest(t, path)
+	if v := userVersion(t, am.db); v != len(migrations) {
+		t.Fatalf("user_version = %d after the first open, want %d", v, len(migrations))
+	}
+	insert(t, am, "a")
+	if err := am.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening applies nothing and keeps the data.
+	am = openTest(t, path)
+	if v := userVersion(t, am.db); v != len(migrations) {
+		t.Errorf("user_version = %d after reopening, want %d", v, len(migrations))
+	}
+	if n := am.Len(ctx); n != 1 {
+		t.Errorf("Len() = %d after reopening, want 1", n)
+	}
+}
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gowarp.db")
+
+	// A database created before the states were introduced.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		migrations[0],
+		`PRAGMA user_version = 1`,
+		`INSERT INTO accounts (account_type, referral_count, license) VALUES ('limited', '1', 'old')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	am := openTest(t, path)
+	if v := userVersion(t, am.db); v != len(migrations) {
+		t.Errorf("user_version = %d, want %d", v, len(migrations))
+	}
+	acc, err := am.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("Lease() = %v, want the old account available", err)
+	}
+	if acc.License != "old" {
+		t.Errorf("License = %q, want %q", acc.License, "old")
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	ctx := context.Background()
+	am := newTestModel(t)
+
+	id := insert(t, am, "a")
+	if n := am.Len(ctx); n != 1 {
+		t.Fatalf("Len() = %d, want 1", n)
+	}
+
+	acc, err := am.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.ID != id || acc.License != "a" || acc.State != models.StateLeased || acc.RefCount != "1" {
+		t.Errorf("Lease() = %+v, want the leased account %v", acc, id)
+	}
+	if until := time.Until(acc.LeasedUntil); until <= 0 || until > time.Minute {
+		t.Errorf("LeasedUntil is in %s, want within a minute", until)
+	}
+	if _, err := am.Lease(ctx, time.Minute); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("Lease() of an empty pool = %v, want ErrNoRecord", err)
+	}
+
+	// Release puts the key back, but only while it is leased.
+	if err := am.Release(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.Release(ctx, id); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("Release() of an available account = %v, want ErrNoRecord", err)
+	}
+	if n := am.Len(ctx); n != 1 {
+		t.Errorf("Len() after Release = %d, want 1", n)
+	}
+
+	if _, err := am.Lease(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.Confirm(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.Confirm(ctx, id); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("Confirm() of a delivered account = %v, want ErrNoRecord", err)
+	}
+	if n := am.Len(ctx); n != 0 {
+		t.Errorf("Len() after Confirm = %d, want 0", n)
+	}
+
+	// The delivered key is only removed once it is older than the cutoff.
+	if n, err := am.PurgeDelivered(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("PurgeDelivered(an hour ago) = %d, %v, want 0", n, err)
+	}
+	if n, err := am.PurgeDelivered(ctx, time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("PurgeDelivered(now) = %d, %v, want 1", n, err)
+	}
+
+	if err := am.Confirm(ctx, "invalid"); !errors.Is(err, models.ErrInvalidKey) {
+		t.Errorf("Confirm() with an invalid id = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestExpireLeases(t *testing.T) {
+	ctx := context.Background()
+	am := newTestModel(t)
+
+	expiring := insert(t, am, "expiring")
+	if _, err := am.Lease(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	insert(t, am, "leased")
+	if _, err := am.Lease(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := am.ExpireLeases(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("ExpireLeases() = %d, want 1", n)
+	}
+
+	// The expired key is servable again, and can't be confirmed by its old lease anymore.
+	if err := am.Confirm(ctx, expiring); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("Confirm() of an expired lease = %v, want ErrNoRecord", err)
+	}
+	acc, err := am.Lease(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.License != "expiring" {
+		t.Errorf("Lease() = %q, want the expired account", acc.License)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	ctx := context.Background()
+	am := newTestModel(t)
+
+	created := time.Now().Truncate(time.Second)
+	for _, tok := range []models.Token{
+		{ID: "1", Name: "alice", Hash: "hash1", DailyQuota: 10, CreatedAt: created},
+		{ID: "2", Name: "bob", Hash: "hash2", CreatedAt: created.Add(time.Second)},
+	} {
+		if err := am.InsertToken(ctx, &tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := am.InsertToken(ctx, &models.Token{ID: "3", Hash: "hash1", CreatedAt: created}); err == nil {
+		t.Error("InsertToken() with a duplicate hash succeeded")
+	}
+
+	tok, err := am.GetTokenByHash(ctx, "hash1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.ID != "1" || tok.Name != "alice" || tok.DailyQuota != 10 || !tok.CreatedAt.Equal(created) || tok.Revoked() {
+		t.Errorf("GetTokenByHash() = %+v", tok)
+	}
+	if _, err := am.GetTokenByHash(ctx, "unknown"); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("GetTokenByHash() of an unknown hash = %v, want ErrNoRecord", err)
+	}
+
+	if err := am.RevokeToken(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.RevokeToken(ctx, "unknown"); !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("RevokeToken() of an unknown id = %v, want ErrNoRecord", err)
+	}
+
+	tokens, err := am.ListTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].ID != "1" || tokens[1].ID != "2" {
+		t.Fatalf("ListTokens() = %+v, want both tokens by creation time", tokens)
+	}
+	if tokens[0].Revoked() || !tokens[1].Revoked() {
+		t.Errorf("revoked = %t, %t, want only the second token revoked", tokens[0].Revoked(), tokens[1].Revoked())
+	}
+}
+
+func TestCounters(t *testing.T) {
+	ctx := context.Background()
+	am := newTestModel(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	for want := int64(1); want <= 2; want++ {
+		n, err := am.IncrCounter(ctx, "a", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("IncrCounter() = %d, want %d", n, want)
+		}
+	}
+	if n, err := am.Counter(ctx, "a"); err != nil || n != 2 {
+		t.Errorf("Counter() = %d, %v, want 2", n, err)
+	}
+
+	for _, want := range []int64{1, 0, 0} {
+		n, err := am.DecrCounter(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("DecrCounter() = %d, want %d", n, want)
+		}
+	}
+	if n, err := am.DecrCounter(ctx, "missing"); err != nil || n != 0 {
+		t.Errorf("DecrCounter() of a missing counter = %d, %v, want 0", n, err)
+	}
+	if n, err := am.Counter(ctx, "missing"); err != nil || n != 0 {
+		t.Errorf("Counter() of a missing counter = %d, %v, want 0", n, err)
+	}
+}
+
+func TestExpiredCounters(t *testing.T) {
+	ctx := context.Background()
+	am := newTestModel(t)
+
+	if _, err := am.IncrCounter(ctx, "expired", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := am.Counter(ctx, "expired"); err != nil || n != 0 {
+		t.Errorf("Counter() of an expired counter = %d, %v, want 0", n, err)
+	}
+	if n, err := am.DecrCounter(ctx, "expired"); err != nil || n != 0 {
+		t.Errorf("DecrCounter() of an expired counter = %d, %v, want 0", n, err)
+	}
+
+	// An expired counter starts over with the new expiry.
+	n, err := am.IncrCounter(ctx, "expired", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("IncrCounter() of an expired counter = %d, want 1", n)
+	}
+	if n, err := am.Counter(ctx, "expired"); err != nil || n != 1 {
+		t.Errorf("Counter() after starting over = %d, %v, want 1", n, err)
+	}
+
+	// Creating a counter drops the expired ones.
+	if _, err := am.IncrCounter(ctx, "stale", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := am.IncrCounter(ctx, "new", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := am.db.QueryRow(`SELECT COUNT(*) FROM counters WHERE key = 'stale'`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Error("the expired counter was not dropped")
+	}
+}
+
+func TestConcurrentLease(t *testing.T) {
+	modelstest.TestConcurrentLease(t, newTestModel(t))
+}